@@ -0,0 +1,314 @@
+// Copyright 2012 - 2014 Alex Palaistras. All rights reserved.
+// Use of this source code is governed by the MIT License, the
+// full text of which can be found in the LICENSE file.
+
+// Package audit records calls made to module methods, along with the user
+// making each call, its duration and outcome, as well as calls rejected before
+// reaching a module, in the system database. Entries
+// are written in the background, and are kept for a configurable time.
+package audit
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/deuill/sleepy/core/config"
+	"github.com/deuill/sleepy/core/server"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Entry represents a single call recorded in the audit log.
+type Entry struct {
+	Time     time.Time     // Time is the time the call was made.
+	User     int           // User is the id of the user making the call, or zero if not authenticated.
+	Module   string        // Module is the name of the module called.
+	Method   string        // Method is the name of the method called.
+	Duration time.Duration // Duration is the time taken for the call to complete.
+	Code     int           // Code is the error code returned, or zero if the call succeeded.
+	Error    string        // Error is the error message returned, if any.
+	Params   string        // Params is a summary of call parameters, with sensitive values redacted.
+}
+
+// Maximum number of entries waiting to be written, after which further entries
+// are dropped.
+const queueSize = 1024
+
+// Maximum number of entries written in a single transaction.
+const batchSize = 128
+
+var db *sql.DB
+
+// Settings for the audit log, as set in Setup.
+var settings struct {
+	enabled    bool
+	retention  time.Duration
+	maxEntries int64
+	fields     map[string]bool
+	methods    map[string]bool
+}
+
+// Entries waiting to be written, along with a flag denoting whether the audit
+// log has been closed and the number of entries dropped due to a full queue.
+var queue struct {
+	sync.RWMutex
+	entries chan *Entry
+	done    chan struct{}
+	closed  bool
+	dropped atomic.Int64
+}
+
+// Setup connects to the system database in 'filename', under 'datadir', and
+// creates the audit log table, if not already created. Calls to module methods
+// are recorded from then on, unless disabled in 'conf'. The audit log is kept
+// in the system database even if users are kept elsewhere, so that each
+// instance of Sleepy keeps its own audit log.
+func Setup(datadir, filename string, conf *config.Config) error {
+	var err error
+
+	// Writes may contend with those made by other connections to the system
+	// database, in which case we wait for the database to become available.
+	db, err = sql.Open("sqlite3", datadir+"/"+filename+"?_busy_timeout=5000")
+	if err != nil {
+		return fmt.Errorf("Error initializing audit log: %s", err)
+	}
+
+	query := `CREATE TABLE IF NOT EXISTS audit_log (
+		time INTEGER, user_id INTEGER, module TEXT, method TEXT,
+		duration INTEGER, code INTEGER, error TEXT, params TEXT
+	)`
+
+	if _, err = db.Exec(query); err != nil {
+		return fmt.Errorf("Error initializing audit log: %s", err)
+	}
+
+	query = `CREATE INDEX IF NOT EXISTS audit_log_time ON audit_log (time)`
+	if _, err = db.Exec(query); err != nil {
+		return fmt.Errorf("Error initializing audit log: %s", err)
+	}
+
+	if settings.enabled, err = conf.Bool("audit", "enabled"); err != nil {
+		settings.enabled = true
+	}
+
+	retention, err := conf.Int("audit", "retention")
+	if err != nil {
+		retention = 90
+	}
+
+	settings.retention = time.Duration(retention) * 24 * time.Hour
+	settings.maxEntries = conf.I("audit", "max-entries")
+
+	fields, err := conf.String("audit", "redact-fields")
+	if err != nil {
+		fields = "auth,authkey,password,passwd,secret,token"
+	}
+
+	methods, err := conf.String("audit", "redact-methods")
+	if err != nil {
+		methods = "Auth.*"
+	}
+
+	settings.fields = list(strings.ToLower(fields))
+	settings.methods = list(methods)
+
+	if settings.enabled {
+		queue.entries = make(chan *Entry, queueSize)
+		queue.done = make(chan struct{})
+		go write()
+	}
+
+	return nil
+}
+
+// Record adds entry to the audit log. Entries are written in the background,
+// and are dropped if the audit log is disabled or entries are recorded faster
+// than they can be written.
+func Record(e *Entry) {
+	queue.RLock()
+	defer queue.RUnlock()
+
+	if queue.entries == nil || queue.closed {
+		return
+	}
+
+	select {
+	case queue.entries <- e:
+	default:
+		queue.dropped.Add(1)
+	}
+}
+
+// Close writes any entries waiting to be written and closes the connection to
+// the system database.
+func Close() error {
+	queue.Lock()
+	if queue.entries != nil && !queue.closed {
+		queue.closed = true
+		close(queue.entries)
+	}
+	queue.Unlock()
+
+	if queue.done != nil {
+		<-queue.done
+	}
+
+	if db == nil {
+		return nil
+	}
+
+	return db.Close()
+}
+
+// Write entries as they are recorded, until the audit log is closed, removing
+// expired entries periodically.
+func write() {
+	defer close(queue.done)
+
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	expire()
+
+	for {
+		select {
+		case e, ok := <-queue.entries:
+			if !ok {
+				return
+			}
+
+			// Write any entries queued in the meantime in the same transaction.
+			batch := []*Entry{e}
+			for n := len(queue.entries); n > 0 && len(batch) < batchSize; n-- {
+				if e, ok = <-queue.entries; ok {
+					batch = append(batch, e)
+				}
+			}
+
+			if err := store(batch); err != nil {
+				log.Printf("Unable to write audit log: %s", err)
+			}
+
+			if n := queue.dropped.Swap(0); n > 0 {
+				log.Printf("Dropped %d audit log entries, as they could not be written in time", n)
+			}
+		case <-ticker.C:
+			expire()
+		}
+	}
+}
+
+// Write entries in 'batch' to the audit log in a single transaction.
+func store(batch []*Entry) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO audit_log (time, user_id, module, method, duration, code, error, params)
+	          VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+
+	for _, e := range batch {
+		_, err = tx.Exec(query, e.Time.UnixNano(), e.User, e.Module, e.Method, int64(e.Duration), e.Code, e.Error, e.Params)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Remove entries older than the retention period, and the oldest entries in
+// excess of the maximum number of entries kept, if set.
+func expire() {
+	if settings.retention > 0 {
+		query := `DELETE FROM audit_log WHERE time < ?`
+		if _, err := db.Exec(query, time.Now().Add(-settings.retention).UnixNano()); err != nil {
+			log.Printf("Unable to remove expired audit log entries: %s", err)
+		}
+	}
+
+	if settings.maxEntries > 0 {
+		query := `DELETE FROM audit_log WHERE rowid <= (SELECT rowid FROM audit_log ORDER BY rowid DESC LIMIT 1 OFFSET ?)`
+		if _, err := db.Exec(query, settings.maxEntries); err != nil {
+			log.Printf("Unable to remove excess audit log entries: %s", err)
+		}
+	}
+}
+
+// Record calls to module methods, as an interceptor run around every call.
+func intercept(c *server.Call, next server.Handler) (interface{}, error) {
+	if !settings.enabled {
+		return next(c)
+	}
+
+	start := time.Now()
+	result, err := next(c)
+
+	e := &Entry{
+		Time:     start,
+		User:     c.User.Id,
+		Module:   c.Module,
+		Method:   c.Method,
+		Duration: time.Since(start),
+		Params:   summarize(c.Module, c.Method, c.Params),
+	}
+
+	if err != nil {
+		e.Code, e.Error = server.ModuleError, err.Error()
+
+		var se *server.Error
+		if errors.As(err, &se) {
+			e.Code = se.Code
+		}
+	}
+
+	Record(e)
+	return result, err
+}
+
+// Record calls rejected before reaching a module method, e.g. for failing
+// authentication, along with the error returned.
+func rejected(c *server.Call, err *server.Error) {
+	if !settings.enabled {
+		return
+	}
+
+	e := &Entry{
+		Time:   time.Now(),
+		Module: c.Module,
+		Method: c.Method,
+		Code:   err.Code,
+		Error:  err.Message,
+		Params: summarize(c.Module, c.Method, c.Params),
+	}
+
+	if c.User != nil {
+		e.User = c.User.Id
+	}
+
+	Record(e)
+}
+
+// Return set of comma-separated items in 's'.
+func list(s string) map[string]bool {
+	items := make(map[string]bool)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items[item] = true
+		}
+	}
+
+	return items
+}
+
+func init() {
+	server.Intercept(intercept)
+	server.OnReject(rejected)
+}
@@ -0,0 +1,84 @@
+// Copyright 2012 - 2014 Alex Palaistras. All rights reserved.
+// Use of this source code is governed by the MIT License, the
+// full text of which can be found in the LICENSE file.
+
+package audit
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Filter restricts the entries returned by Query. Fields left empty match all
+// entries.
+type Filter struct {
+	User   int       // User is the id of the user making calls.
+	Module string    // Module is the name of the module called.
+	Method string    // Method is the name of the method called.
+	Since  time.Time // Since is the earliest time calls were made.
+	Until  time.Time // Until is the latest time calls were made.
+	Limit  int       // Limit is the maximum number of entries returned.
+}
+
+// Query returns entries in the audit log matching filter 'f', most recent first.
+func Query(f Filter) ([]Entry, error) {
+	var where []string
+	var values []interface{}
+
+	if f.User != 0 {
+		where, values = append(where, "user_id = ?"), append(values, f.User)
+	}
+
+	if f.Module != "" {
+		where, values = append(where, "module = ?"), append(values, f.Module)
+	}
+
+	if f.Method != "" {
+		where, values = append(where, "method = ?"), append(values, f.Method)
+	}
+
+	if !f.Since.IsZero() {
+		where, values = append(where, "time >= ?"), append(values, f.Since.UnixNano())
+	}
+
+	if !f.Until.IsZero() {
+		where, values = append(where, "time <= ?"), append(values, f.Until.UnixNano())
+	}
+
+	query := `SELECT time, user_id, module, method, duration, code, error, params FROM audit_log`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+
+	query += " ORDER BY time DESC"
+	if f.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", f.Limit)
+	}
+
+	rows, err := db.Query(query, values...)
+	if err != nil {
+		return nil, fmt.Errorf("Error fetching audit log: %s", err)
+	}
+
+	defer rows.Close()
+
+	entries := make([]Entry, 0)
+	for rows.Next() {
+		var e Entry
+		var t, d int64
+
+		if err = rows.Scan(&t, &e.User, &e.Module, &e.Method, &d, &e.Code, &e.Error, &e.Params); err != nil {
+			return nil, fmt.Errorf("Error fetching audit log: %s", err)
+		}
+
+		e.Time, e.Duration = time.Unix(0, t), time.Duration(d)
+		entries = append(entries, e)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2012 - 2014 Alex Palaistras. All rights reserved.
+// Use of this source code is governed by the MIT License, the
+// full text of which can be found in the LICENSE file.
+
+package audit
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Maximum length of strings in parameter summaries, and of summaries overall.
+const (
+	maxString  = 64
+	maxSummary = 1024
+)
+
+// Value recorded in place of redacted parameters.
+const redacted = "[redacted]"
+
+// Return summary of parameters 'params' passed to method, encoded as JSON, with
+// values of sensitive fields redacted and long strings truncated. Methods set in
+// 'redact-methods', by name or module wildcard, have parameters redacted in full.
+func summarize(module, method string, params interface{}) string {
+	if params == nil {
+		return ""
+	}
+
+	if settings.methods[module+"."+method] || settings.methods[module+".*"] {
+		return redacted
+	}
+
+	buf, err := json.Marshal(redact(params))
+	if err != nil {
+		return ""
+	}
+
+	if len(buf) > maxSummary {
+		return string(buf[:maxSummary]) + "..."
+	}
+
+	return string(buf)
+}
+
+// Return copy of value 'v' with values of fields set in 'redact-fields' redacted,
+// matched without regard to case, and long strings truncated.
+func redact(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			if settings.fields[strings.ToLower(key)] {
+				m[key] = redacted
+			} else {
+				m[key] = redact(value)
+			}
+		}
+
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i := range v {
+			s[i] = redact(v[i])
+		}
+
+		return s
+	case string:
+		if len(v) > maxString {
+			return v[:maxString] + "..."
+		}
+	}
+
+	return v
+}
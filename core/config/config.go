@@ -60,7 +60,7 @@ func (c *Config) Int(section, option string) (int64, error) {
 	}
 
 	// Return value as int, after conversion, if necessary.
-	switch value := (*c)[section][option].(type) {
+	switch value := c.value(section, option).(type) {
 	case string:
 		num, error := strconv.ParseInt(value, 10, 64)
 		if error != nil {
@@ -70,6 +70,10 @@ func (c *Config) Int(section, option string) (int64, error) {
 		return num, nil
 	case int:
 		return int64(value), nil
+	case int64:
+		return value, nil
+	case float64:
+		return int64(value), nil
 	case bool:
 		if value {
 			return 1, nil
@@ -99,7 +103,7 @@ func (c *Config) Bool(section, option string) (bool, error) {
 	}
 
 	// Return value as bool, after conversion, if necessary.
-	switch value := (*c)[section][option].(type) {
+	switch value := c.value(section, option).(type) {
 	case string:
 		status, error := strconv.ParseBool(value)
 		if error != nil {
@@ -132,7 +136,7 @@ func (c *Config) Float(section, option string) (float64, error) {
 	}
 
 	// Return value as float, after conversion, if necessary.
-	switch value := (*c)[section][option].(type) {
+	switch value := c.value(section, option).(type) {
 	case string:
 		num, error := strconv.ParseFloat(value, 64)
 		if error != nil {
@@ -140,6 +144,10 @@ func (c *Config) Float(section, option string) (float64, error) {
 		}
 
 		return num, nil
+	case int:
+		return float64(value), nil
+	case int64:
+		return float64(value), nil
 	case float64:
 		return value, nil
 	case nil:
@@ -197,6 +205,16 @@ func Load(conf string) (*Config, error) {
 }
 
 // Checks if 'option' exists under 'section' in the Config file.
+// Return value of 'option' in 'section', with byte slices, as returned for
+// text values stored in databases, converted to strings.
+func (c *Config) value(section, option string) interface{} {
+	if b, ok := (*c)[section][option].([]byte); ok {
+		return string(b)
+	}
+
+	return (*c)[section][option]
+}
+
 func (c *Config) exists(section, option string) (bool, error) {
 	if c == nil {
 		return false, fmt.Errorf("config is invalid")
@@ -0,0 +1,102 @@
+// Copyright 2012 - 2014 Alex Palaistras. All rights reserved.
+// Use of this source code is governed by the MIT License, the
+// full text of which can be found in the LICENSE file.
+
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+type handler struct{}
+
+// Handler returns a handler serving all metrics registered in the Prometheus
+// text exposition format.
+func Handler() http.Handler {
+	return &handler{}
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	Write(w)
+}
+
+// Write writes all metrics registered to 'w' in the Prometheus text exposition
+// format.
+func Write(w io.Writer) error {
+	buf := bufio.NewWriter(w)
+
+	for _, m := range collect() {
+		buf.WriteString("# HELP " + m.name + " " + escape(m.help, false) + "\n")
+		buf.WriteString("# TYPE " + m.name + " " + m.kind + "\n")
+
+		if m.fn != nil {
+			buf.WriteString(m.name + " " + formatFloat(m.fn()) + "\n")
+			continue
+		}
+
+		m.Lock()
+		keys := make([]string, 0, len(m.values))
+		for k := range m.values {
+			keys = append(keys, k)
+		}
+
+		sort.Strings(keys)
+		for _, k := range keys {
+			val := m.values[k]
+			if m.kind != "histogram" {
+				buf.WriteString(m.name + labels(m.labels, val.labels) + " " + formatFloat(val.value) + "\n")
+				continue
+			}
+
+			// Bucket upper bounds are given in an additional 'le' label.
+			names := append(m.labels[:len(m.labels):len(m.labels)], "le")
+			values := append(val.labels[:len(val.labels):len(val.labels)], "")
+
+			for i, b := range m.buckets {
+				values[len(values)-1] = formatFloat(b)
+				buf.WriteString(m.name + "_bucket" + labels(names, values) + " " + formatFloat(float64(val.counts[i])) + "\n")
+			}
+
+			values[len(values)-1] = "+Inf"
+			l := labels(names, values)
+			buf.WriteString(m.name + "_bucket" + l + " " + formatFloat(float64(val.count)) + "\n")
+			buf.WriteString(m.name + "_sum" + labels(m.labels, val.labels) + " " + formatFloat(val.value) + "\n")
+			buf.WriteString(m.name + "_count" + labels(m.labels, val.labels) + " " + formatFloat(float64(val.count)) + "\n")
+		}
+		m.Unlock()
+	}
+
+	return buf.Flush()
+}
+
+// Return label set for label names and values given, or an empty string if no
+// labels are given.
+func labels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+	for i := range names {
+		pairs[i] = names[i] + `="` + escape(values[i], true) + `"`
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Escape backslashes and line feeds in 's', as well as double quotes if 'quote'
+// is set, as required for help text and label values.
+func escape(s string, quote bool) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	if quote {
+		s = strings.ReplaceAll(s, `"`, `\"`)
+	}
+
+	return s
+}
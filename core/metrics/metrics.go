@@ -0,0 +1,201 @@
+// Copyright 2012 - 2014 Alex Palaistras. All rights reserved.
+// Use of this source code is governed by the MIT License, the
+// full text of which can be found in the LICENSE file.
+
+// Package metrics contains counters, gauges and histograms for measuring the
+// operation of the server and its modules, exposed over HTTP in the Prometheus
+// text format. Metrics are registered once, usually in package-level variables,
+// and may carry labels, the values of which are given when updating metrics.
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Default histogram buckets, suited to call durations in seconds.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// A metric, as registered with the package, along with its values for each
+// combination of label values.
+type metric struct {
+	sync.Mutex
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	values  map[string]*value
+	fn      func() float64
+}
+
+// Value of metric for a single combination of label values.
+type value struct {
+	labels []string
+	value  float64
+	counts []uint64
+	count  uint64
+}
+
+// Metrics registered, keyed by name.
+var registry struct {
+	sync.Mutex
+	metrics map[string]*metric
+}
+
+// Counter is a value that only increases, e.g. the number of calls made.
+type Counter struct{ m *metric }
+
+// NewCounter registers counter with name and help text given, and with labels
+// named in 'labels', if any.
+func NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{register(&metric{name: name, help: help, kind: "counter", labels: labels})}
+}
+
+// Inc increments counter for label values given by one.
+func (c *Counter) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+// Add increments counter for label values given by 'v', which is expected to
+// be positive.
+func (c *Counter) Add(v float64, labels ...string) {
+	c.m.update(labels, func(val *value) { val.value += v })
+}
+
+// Gauge is a value that may increase or decrease, e.g. the number of open
+// connections.
+type Gauge struct{ m *metric }
+
+// NewGauge registers gauge with name and help text given, and with labels named
+// in 'labels', if any.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{register(&metric{name: name, help: help, kind: "gauge", labels: labels})}
+}
+
+// Set sets gauge for label values given to 'v'.
+func (g *Gauge) Set(v float64, labels ...string) {
+	g.m.update(labels, func(val *value) { val.value = v })
+}
+
+// Add adds 'v', which may be negative, to gauge for label values given.
+func (g *Gauge) Add(v float64, labels ...string) {
+	g.m.update(labels, func(val *value) { val.value += v })
+}
+
+// NewGaugeFunc registers gauge with name and help text given, the value of
+// which is returned by 'fn' whenever metrics are collected. Functions are to
+// be safe for concurrent use.
+func NewGaugeFunc(name, help string, fn func() float64) {
+	register(&metric{name: name, help: help, kind: "gauge", fn: fn})
+}
+
+// Histogram counts observed values, e.g. call durations, in buckets with upper
+// bounds set on registration.
+type Histogram struct{ m *metric }
+
+// NewHistogram registers histogram with name, help text and upper bounds of
+// buckets given, in increasing order, and with labels named in 'labels', if any.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return &Histogram{register(&metric{name: name, help: help, kind: "histogram", labels: labels, buckets: buckets})}
+}
+
+// Observe adds value 'v' to histogram for label values given.
+func (h *Histogram) Observe(v float64, labels ...string) {
+	h.m.update(labels, func(val *value) {
+		if len(val.counts) != len(h.m.buckets) {
+			val.counts = make([]uint64, len(h.m.buckets))
+		}
+
+		for i, b := range h.m.buckets {
+			if v <= b {
+				val.counts[i]++
+			}
+		}
+
+		val.value += v
+		val.count++
+	})
+}
+
+// Register metric 'm', panicking if a metric with the same name has already
+// been registered, as metrics are expected to be registered on start-up.
+func register(m *metric) *metric {
+	registry.Lock()
+	defer registry.Unlock()
+
+	if registry.metrics == nil {
+		registry.metrics = make(map[string]*metric)
+	}
+
+	if _, exists := registry.metrics[m.name]; exists {
+		panic(fmt.Sprintf("Metric '%s' is already registered.", m.name))
+	}
+
+	m.values = make(map[string]*value)
+	registry.metrics[m.name] = m
+
+	// Metrics without labels are reported from the start.
+	if len(m.labels) == 0 {
+		m.values[""] = &value{counts: make([]uint64, len(m.buckets))}
+	}
+
+	return m
+}
+
+// Apply function 'fn' to value of metric for label values given, creating the
+// value if none exists. Missing label values are treated as empty.
+func (m *metric) update(labels []string, fn func(val *value)) {
+	if len(labels) != len(m.labels) {
+		l := make([]string, len(m.labels))
+		copy(l, labels)
+		labels = l
+	}
+
+	key := strings.Join(labels, "\xff")
+
+	m.Lock()
+	defer m.Unlock()
+
+	val, exists := m.values[key]
+	if !exists {
+		val = &value{labels: labels}
+		m.values[key] = val
+	}
+
+	fn(val)
+}
+
+// Return metrics registered, sorted by name.
+func collect() []*metric {
+	registry.Lock()
+	defer registry.Unlock()
+
+	metrics := make([]*metric, 0, len(registry.metrics))
+	for _, m := range registry.metrics {
+		metrics = append(metrics, m)
+	}
+
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].name < metrics[j].name
+	})
+
+	return metrics
+}
+
+// Format floating-point value 'v' as expected by Prometheus.
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+
+	return fmt.Sprint(v)
+}
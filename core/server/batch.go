@@ -0,0 +1,335 @@
+// Copyright 2012 - 2014 Alex Palaistras. All rights reserved.
+// Use of this source code is governed by the MIT License, the
+// full text of which can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/deuill/sleepy/core/user"
+)
+
+// Batch represents a set of requests passed to CallMany, either as a plain list
+// of requests or as an object containing the list of requests in 'Requests',
+// along with options controlling how the batch is run.
+//
+// Batches run as a unit, with 'Unit' set to true, are checked as a whole before
+// any request is run, and nothing is run if any request fails authentication,
+// calls a method the user is not permitted to call or refers to an unknown
+// request. Requests may use results of earlier requests in their parameters via
+// placeholders of the form '${name}' or '${name.path.to.value}', where 'name'
+// matches the 'Ref' field of an earlier request. Requests not depending on each
+// other are run concurrently, up to the number of calls the user may run at the
+// same time, and requests whose dependencies fail are not run. A result or error
+// is returned for every request, in the order given.
+//
+// Batches are not transactional: side effects of requests that complete are not
+// rolled back if other requests in the batch fail.
+type Batch struct {
+	Requests []*Request
+	Unit     bool
+}
+
+func (b *Batch) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		return json.Unmarshal(data, &b.Requests)
+	}
+
+	type batch Batch
+	return json.Unmarshal(data, (*batch)(b))
+}
+
+// Check that batch contains no empty requests, as decoded from 'null' entries.
+func (b *Batch) check() error {
+	for i, r := range b.Requests {
+		if r == nil {
+			return Errorf(InvalidRequest, "Request #%d in batch is empty.", i)
+		}
+	}
+
+	return nil
+}
+
+// Response represents the outcome of a single request in a batch run as a unit.
+type Response struct {
+	Result interface{}
+	Error  *Error
+}
+
+// Matches placeholders referring to results of other requests in batch.
+var refPattern = regexp.MustCompile(`\$\{([^}.]+)((?:\.[^}.]+)*)\}`)
+
+// Run batch as a unit, returning a response for every request.
+func (b *Batch) run() []*Response {
+	var failed bool
+
+	responses := make([]*Response, len(b.Requests))
+	users := make([]*user.User, len(b.Requests))
+	methods := make([]reflect.Value, len(b.Requests))
+	deps := make([][]int, len(b.Requests))
+	refs := make(map[string]int)
+
+	// Validate all requests and resolve dependencies before running any.
+	for i, r := range b.Requests {
+		var err error
+		if users[i], methods[i], err = lookup(r); err == nil {
+			deps[i], err = dependencies(r.Params, refs)
+		}
+
+		if err == nil && r.Ref != "" {
+			if _, exists := refs[r.Ref]; exists {
+				err = Errorf(InvalidRequest, "Reference '%s' is used by more than one request.", r.Ref)
+			}
+
+			refs[r.Ref] = i
+		}
+
+		if err != nil {
+			responses[i] = &Response{Error: toError(err)}
+			failed = true
+		}
+	}
+
+	if failed {
+		for i := range responses {
+			if responses[i] == nil {
+				responses[i] = &Response{Error: Errorf(BatchError, "Request not run, batch failed validation.")}
+			}
+		}
+
+		return responses
+	}
+
+	var wg sync.WaitGroup
+	done := make([]chan bool, len(b.Requests))
+	for i := range done {
+		done[i] = make(chan bool)
+	}
+
+	for i, r := range b.Requests {
+		wg.Add(1)
+		go func(i int, r *Request) {
+			defer wg.Done()
+			defer close(done[i])
+
+			// Wait for dependencies to complete, collecting their results.
+			results := make(map[string]interface{}, len(deps[i]))
+			for _, d := range deps[i] {
+				<-done[d]
+				if responses[d].Error != nil {
+					responses[i] = &Response{Error: Errorf(BatchError, "Request not run, request #%d failed.", d)}
+					return
+				}
+
+				results[b.Requests[d].Ref] = responses[d].Result
+			}
+
+			params, err := resolve(r.Params, results)
+			if err != nil {
+				responses[i] = &Response{Error: toError(err)}
+				return
+			}
+
+			ctx, cancel := r.context()
+			defer cancel()
+
+			// Requests wait for others in the batch to complete, rather than
+			// fail, where more are run than the user may run at the same time.
+			release, err := await(ctx, users[i], r)
+			if err != nil {
+				responses[i] = &Response{Error: toError(err)}
+				return
+			}
+
+			result, err := perform(&Call{users[i], r.Module, r.Method, params, ctx, r.hold(release)}, methods[i])
+			if err != nil {
+				responses[i] = &Response{Error: toError(err)}
+				return
+			}
+
+			responses[i] = &Response{Result: result}
+		}(i, r)
+	}
+
+	wg.Wait()
+	return responses
+}
+
+// Return indices of requests referred to by placeholders in 'params', as found
+// in 'refs'.
+func dependencies(params interface{}, refs map[string]int) ([]int, error) {
+	var deps []int
+
+	switch p := params.(type) {
+	case string:
+		for _, m := range refPattern.FindAllStringSubmatch(p, -1) {
+			i, exists := refs[m[1]]
+			if !exists {
+				return nil, Errorf(InvalidParams, "Placeholder '%s' refers to unknown request.", m[0])
+			}
+
+			deps = append(deps, i)
+		}
+	case []interface{}:
+		for _, v := range p {
+			d, err := dependencies(v, refs)
+			if err != nil {
+				return nil, err
+			}
+
+			deps = append(deps, d...)
+		}
+	case map[string]interface{}:
+		for _, v := range p {
+			d, err := dependencies(v, refs)
+			if err != nil {
+				return nil, err
+			}
+
+			deps = append(deps, d...)
+		}
+	}
+
+	return deps, nil
+}
+
+// Return copy of 'params' with placeholders replaced by values from 'results'.
+// Strings consisting of a single placeholder are replaced by the referenced
+// value as-is, while placeholders within longer strings are replaced by the
+// referenced value's string representation.
+func resolve(params interface{}, results map[string]interface{}) (interface{}, error) {
+	switch p := params.(type) {
+	case string:
+		if m := refPattern.FindStringSubmatch(p); m != nil && m[0] == p {
+			return reference(m, results)
+		}
+
+		var err error
+		s := refPattern.ReplaceAllStringFunc(p, func(ph string) string {
+			v, e := reference(refPattern.FindStringSubmatch(ph), results)
+			if e != nil {
+				err = e
+				return ph
+			}
+
+			return format(v)
+		})
+
+		return s, err
+	case []interface{}:
+		r := make([]interface{}, len(p))
+		for i, v := range p {
+			var err error
+			if r[i], err = resolve(v, results); err != nil {
+				return nil, err
+			}
+		}
+
+		return r, nil
+	case map[string]interface{}:
+		r := make(map[string]interface{}, len(p))
+		for k, v := range p {
+			var err error
+			if r[k], err = resolve(v, results); err != nil {
+				return nil, err
+			}
+		}
+
+		return r, nil
+	}
+
+	return params, nil
+}
+
+// Return value referred to by placeholder match 'm', walking the path, if any,
+// through the result as represented in JSON.
+func reference(m []string, results map[string]interface{}) (interface{}, error) {
+	if m[2] == "" {
+		return normalize(results[m[1]])
+	}
+
+	value, err := normalize(results[m[1]])
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range strings.Split(m[2][1:], ".") {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			var exists bool
+			if value, exists = v[key]; exists {
+				continue
+			}
+
+			// Fall back to case-insensitive match, as used for parameters.
+			for k := range v {
+				if strings.EqualFold(k, key) {
+					value, exists = v[k], true
+					break
+				}
+			}
+
+			if !exists {
+				return nil, Errorf(InvalidParams, "Placeholder '%s' does not match result of request.", m[0])
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, Errorf(InvalidParams, "Placeholder '%s' does not match result of request.", m[0])
+			}
+
+			value = v[i]
+		default:
+			return nil, Errorf(InvalidParams, "Placeholder '%s' does not match result of request.", m[0])
+		}
+	}
+
+	return value, nil
+}
+
+// Convert arbitrary value to its generic JSON representation, so that it may be
+// passed as a parameter to other methods.
+func normalize(value interface{}) (interface{}, error) {
+	buf, err := json.Marshal(value)
+	if err != nil {
+		return nil, Errorf(InternalError, "Could not convert result of request: %s", err)
+	}
+
+	var v interface{}
+	if err = json.Unmarshal(buf, &v); err != nil {
+		return nil, Errorf(InternalError, "Could not convert result of request: %s", err)
+	}
+
+	return v, nil
+}
+
+// Format generic JSON value as string. Arrays and objects are formatted as JSON,
+// without HTML escaping, as the string is not embedded in HTML.
+func format(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	}
+
+	var buf bytes.Buffer
+
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(value)
+
+	return strings.TrimSuffix(buf.String(), "\n")
+}
@@ -0,0 +1,209 @@
+// Copyright 2012 - 2014 Alex Palaistras. All rights reserved.
+// Use of this source code is governed by the MIT License, the
+// full text of which can be found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestDependencies(t *testing.T) {
+	refs := map[string]int{"user": 0, "files": 2}
+
+	tests := []struct {
+		name   string
+		params string
+		want   []int
+		err    string
+	}{
+		{"no parameters", `null`, nil, ""},
+		{"no placeholders", `{"name":"a","ids":[1,2]}`, nil, ""},
+		{"whole value", `{"id":"${user}"}`, []int{0}, ""},
+		{"with path", `{"id":"${user.Id}"}`, []int{0}, ""},
+		{"within string", `"${user.Name} has ${files.0.Size} bytes"`, []int{0, 2}, ""},
+		{"nested", `{"where":[{"id":"${files.1.Id}"}],"owner":"${user}"}`, []int{0, 2}, ""},
+		{"not a placeholder", `{"price":"$5", "path":"{user}"}`, nil, ""},
+		{"unknown request", `{"id":"${account.Id}"}`, nil, "Placeholder '${account.Id}' refers to unknown request."},
+		{"unknown request, nested", `[1,{"a":["${user}","${nope}"]}]`, nil, "Placeholder '${nope}' refers to unknown request."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var params interface{}
+			if err := json.Unmarshal([]byte(tt.params), &params); err != nil {
+				t.Fatalf("invalid parameters '%s': %s", tt.params, err)
+			}
+
+			deps, err := dependencies(params, refs)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("dependencies(%s) returned error %v, want '%s'", tt.params, err, tt.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("dependencies(%s) returned error: %s", tt.params, err)
+			}
+
+			sort.Ints(deps)
+			if !reflect.DeepEqual(deps, tt.want) {
+				t.Errorf("dependencies(%s) = %v, want %v", tt.params, deps, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolve(t *testing.T) {
+	type file struct {
+		Id   int
+		Size int64  `json:"size"`
+		Name string `json:"-"`
+	}
+
+	results := map[string]interface{}{
+		"user":  map[string]interface{}{"Id": 7, "Name": "Alex", "Active": true, "Labels": []string{"a", "b"}},
+		"files": []file{{1, 1024, "a.txt"}, {2, 2048, "b.txt"}},
+		"count": 2,
+		"none":  nil,
+	}
+
+	tests := []struct {
+		name   string
+		params string
+		want   string
+		err    string
+	}{
+		{"no placeholders", `{"name":"a","ids":[1,2]}`, `{"name":"a","ids":[1,2]}`, ""},
+		{"whole value", `{"owner":"${user}"}`, `{"owner":{"Id":7,"Name":"Alex","Active":true,"Labels":["a","b"]}}`, ""},
+		{"whole value keeps type", `{"id":"${user.Id}","active":"${user.Active}"}`, `{"id":7,"active":true}`, ""},
+		{"array index", `"${files.1.Id}"`, `2`, ""},
+		{"struct tags", `["${files.0.size}","${files.0}"]`, `[1024,{"Id":1,"size":1024}]`, ""},
+		{"case-insensitive key", `"${user.name}"`, `"Alex"`, ""},
+		{"null", `"${none}"`, `null`, ""},
+		{"within string", `"${user.Name} has ${count} files of ${files.0.size} bytes"`, `"Alex has 2 files of 1024 bytes"`, ""},
+		{"within string, non-scalar", `"labels: ${user.Labels}, none: '${none}'"`, `"labels: [\"a\",\"b\"], none: ''"`, ""},
+		{"nested", `{"where":[{"id":"${files.1.Id}"}]}`, `{"where":[{"id":2}]}`, ""},
+		{"unknown key", `"${user.Email}"`, ``, "Placeholder '${user.Email}' does not match result of request."},
+		{"index out of range", `"${files.2.Id}"`, ``, "Placeholder '${files.2.Id}' does not match result of request."},
+		{"index not a number", `"${files.first}"`, ``, "Placeholder '${files.first}' does not match result of request."},
+		{"path into scalar", `"${count.value}"`, ``, "Placeholder '${count.value}' does not match result of request."},
+		{"within string, no match", `"id ${user.Email}"`, ``, "Placeholder '${user.Email}' does not match result of request."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var params interface{}
+			if err := json.Unmarshal([]byte(tt.params), &params); err != nil {
+				t.Fatalf("invalid parameters '%s': %s", tt.params, err)
+			}
+
+			got, err := resolve(params, results)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("resolve(%s) returned error %v, want '%s'", tt.params, err, tt.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("resolve(%s) returned error: %s", tt.params, err)
+			}
+
+			var want interface{}
+			if err = json.Unmarshal([]byte(tt.want), &want); err != nil {
+				t.Fatalf("invalid result '%s': %s", tt.want, err)
+			}
+
+			if !reflect.DeepEqual(got, want) {
+				buf, _ := json.Marshal(got)
+				t.Errorf("resolve(%s) = %s, want %s", tt.params, buf, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveCopies(t *testing.T) {
+	var params interface{}
+	json.Unmarshal([]byte(`{"ids":["${count}"]}`), &params)
+
+	if _, err := resolve(params, map[string]interface{}{"count": 2}); err != nil {
+		t.Fatalf("resolve returned error: %s", err)
+	}
+
+	if ids := params.(map[string]interface{})["ids"].([]interface{}); ids[0] != "${count}" {
+		t.Errorf("resolve modified original parameters, placeholder replaced by %v", ids[0])
+	}
+}
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		want  string
+	}{
+		{nil, ""},
+		{1024.0, "1024"},
+		{0.5, "0.5"},
+		{1e21, "1000000000000000000000"},
+		{"a b", "a b"},
+		{true, "true"},
+		{[]interface{}{"a", 1.0}, `["a",1]`},
+		{map[string]interface{}{"a": "<b>"}, `{"a":"<b>"}`},
+	}
+
+	for _, tt := range tests {
+		if got := format(tt.value); got != tt.want {
+			t.Errorf("format(%#v) = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestBatchUnmarshal(t *testing.T) {
+	tests := []struct {
+		name  string
+		src   string
+		count int
+		unit  bool
+		err   string
+	}{
+		{"list", `[{"Module":"A","Method":"B"},{"Module":"A","Method":"C"}]`, 2, false, ""},
+		{"object", `{"Requests":[{"Module":"A","Method":"B"}],"Unit":true}`, 1, true, ""},
+		{"object, not unit", `{"Requests":[{"Module":"A","Method":"B"}]}`, 1, false, ""},
+		{"leading whitespace", " \n[{\"Module\":\"A\",\"Method\":\"B\"}]", 1, false, ""},
+		{"empty entry", `{"Requests":[{"Module":"A","Method":"B"},null]}`, 2, false, "Request #1 in batch is empty."},
+		{"empty entry, list", `[null]`, 1, false, "Request #0 in batch is empty."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b Batch
+			if err := json.Unmarshal([]byte(tt.src), &b); err != nil {
+				t.Fatalf("unmarshal(%s) returned error: %s", strings.TrimSpace(tt.src), err)
+			}
+
+			if len(b.Requests) != tt.count || b.Unit != tt.unit {
+				t.Fatalf("unmarshal(%s) gave %d requests, unit = %v, want %d requests, unit = %v", tt.src, len(b.Requests), b.Unit, tt.count, tt.unit)
+			}
+
+			err := b.check()
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("check returned error %v, want '%s'", err, tt.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("check returned error: %s", err)
+			}
+		})
+	}
+}
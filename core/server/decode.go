@@ -0,0 +1,317 @@
+// Copyright 2012 - 2014 Alex Palaistras. All rights reserved.
+// Use of this source code is governed by the MIT License, the
+// full text of which can be found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A decoder copies generic values, as decoded from JSON, into typed values for
+// use as method parameters. Struct fields are matched against object keys case-
+// insensitively, and fields of embedded structs are treated as if they belonged
+// to the outer struct.
+//
+// Strict decoders fail on unknown keys, values that do not match the type of
+// the destination and missing fields tagged with `sleepy:"required"`, while
+// non-strict decoders ignore unknown keys and leave mismatched values zeroed.
+// Errors contain the full path to the offending value, for example:
+//
+//	Request.Join[2].Conditions[0]: expected string, got number
+type decoder struct {
+	strict bool
+}
+
+// Copy value in 'src' to 'dest', where 'path' is the path to the value for use
+// in error messages.
+func (d *decoder) decode(path string, src interface{}, dest reflect.Value) error {
+	if src == nil {
+		return nil
+	}
+
+	switch dest.Kind() {
+	case reflect.Ptr:
+		v := reflect.New(dest.Type().Elem())
+		if err := d.decode(path, src, v.Elem()); err != nil {
+			return err
+		}
+
+		dest.Set(v)
+		return nil
+	case reflect.Interface:
+		v := reflect.ValueOf(src)
+		if !v.Type().AssignableTo(dest.Type()) {
+			return d.mismatch(path, src, dest)
+		}
+
+		dest.Set(v)
+		return nil
+	case reflect.Struct:
+		if dest.Type() == timeType {
+			return d.decodeTime(path, src, dest)
+		}
+
+		if s, ok := src.(map[string]interface{}); ok {
+			return d.decodeStruct(path, s, dest)
+		}
+	case reflect.Map:
+		if m, ok := src.(map[string]interface{}); ok && dest.Type().Key().Kind() == reflect.String {
+			dest.Set(reflect.MakeMap(dest.Type()))
+
+			for k, v := range m {
+				elem := reflect.New(dest.Type().Elem()).Elem()
+				if err := d.decode(path+"."+k, v, elem); err != nil {
+					return err
+				}
+
+				dest.SetMapIndex(reflect.ValueOf(k).Convert(dest.Type().Key()), elem)
+			}
+
+			return nil
+		}
+	case reflect.Slice, reflect.Array:
+		if s, ok := src.([]interface{}); ok {
+			if dest.Kind() == reflect.Slice {
+				dest.Set(reflect.MakeSlice(dest.Type(), len(s), len(s)))
+			} else if len(s) > dest.Len() {
+				return fmt.Errorf("%s: expected at most %d items, got %d", path, dest.Len(), len(s))
+			}
+
+			for i, v := range s {
+				if err := d.decode(path+"["+strconv.Itoa(i)+"]", v, dest.Index(i)); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		}
+	case reflect.Bool:
+		if b, ok := src.(bool); ok {
+			dest.SetBool(b)
+			return nil
+		}
+	case reflect.String:
+		if s, ok := src.(string); ok {
+			dest.SetString(s)
+			return nil
+		}
+	case reflect.Float32, reflect.Float64:
+		if f, ok := src.(float64); ok {
+			dest.SetFloat(f)
+			return nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if f, ok := src.(float64); ok {
+			// Range is checked before conversion, as converting floats out of
+			// range for int64 gives implementation-specific results. Numbers
+			// not fitting are left as the zero value, unless decoding strictly.
+			max := math.Ldexp(1, dest.Type().Bits()-1)
+			if f != math.Trunc(f) || f < -max || f >= max {
+				if d.strict {
+					return fmt.Errorf("%s: number %v does not fit in %s", path, f, dest.Type())
+				}
+
+				return d.mismatch(path, src, dest)
+			}
+
+			dest.SetInt(int64(f))
+			return nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if f, ok := src.(float64); ok {
+			max := math.Ldexp(1, dest.Type().Bits())
+			if f != math.Trunc(f) || f < 0 || f >= max {
+				if d.strict {
+					return fmt.Errorf("%s: number %v does not fit in %s", path, f, dest.Type())
+				}
+
+				return d.mismatch(path, src, dest)
+			}
+
+			dest.SetUint(uint64(f))
+			return nil
+		}
+	}
+
+	return d.mismatch(path, src, dest)
+}
+
+// Copy object in 'src' to struct in 'dest'.
+func (d *decoder) decodeStruct(path string, src map[string]interface{}, dest reflect.Value) error {
+	fields := make(map[string]reflect.StructField)
+	for _, f := range reflect.VisibleFields(dest.Type()) {
+		if f.PkgPath == "" {
+			fields[strings.ToLower(f.Name)] = f
+		}
+	}
+
+	for key, v := range src {
+		f, exists := fields[strings.ToLower(key)]
+		if !exists {
+			if d.strict {
+				return fmt.Errorf("%s.%s: unknown field", path, key)
+			}
+
+			continue
+		}
+
+		field, err := fieldByIndex(dest, f.Index)
+		if err != nil {
+			return fmt.Errorf("%s.%s: %s", path, f.Name, err)
+		}
+
+		if err = d.decode(path+"."+f.Name, v, field); err != nil {
+			return err
+		}
+	}
+
+	if d.strict {
+		for name, f := range fields {
+			if !isRequired(f) {
+				continue
+			}
+
+			if v, exists := lookupKey(src, name); !exists || v == nil {
+				return fmt.Errorf("%s.%s: required field is missing", path, f.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Copy timestamp in 'src' to time.Time value in 'dest'. Timestamps are either
+// strings formatted according to RFC 3339, or numbers containing seconds since
+// the Unix epoch.
+func (d *decoder) decodeTime(path string, src interface{}, dest reflect.Value) error {
+	switch s := src.(type) {
+	case string:
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			if d.strict {
+				return fmt.Errorf("%s: expected RFC 3339 timestamp, got '%s'", path, s)
+			}
+
+			return nil
+		}
+
+		dest.Set(reflect.ValueOf(t))
+		return nil
+	case float64:
+		sec, frac := math.Modf(s)
+		dest.Set(reflect.ValueOf(time.Unix(int64(sec), int64(frac*1e9))))
+		return nil
+	}
+
+	return d.mismatch(path, src, dest)
+}
+
+// Return error for value in 'src' not matching type of 'dest', or leave 'dest'
+// zeroed for non-strict decoders.
+func (d *decoder) mismatch(path string, src interface{}, dest reflect.Value) error {
+	if !d.strict {
+		dest.Set(reflect.Zero(dest.Type()))
+		return nil
+	}
+
+	return fmt.Errorf("%s: expected %s, got %s", path, typeName(dest.Type()), jsonType(src))
+}
+
+// Return value for field at 'index', allocating embedded struct pointers along
+// the way as needed.
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, error) {
+	for i, n := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !v.CanSet() {
+					return reflect.Value{}, fmt.Errorf("cannot set embedded field of unexported type")
+				}
+
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+
+			v = v.Elem()
+		}
+
+		v = v.Field(n)
+	}
+
+	return v, nil
+}
+
+// Return true if struct field has been tagged as required.
+func isRequired(f reflect.StructField) bool {
+	for _, opt := range strings.Split(f.Tag.Get("sleepy"), ",") {
+		if opt == "required" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Find key in object case-insensitively.
+func lookupKey(src map[string]interface{}, key string) (interface{}, bool) {
+	for k, v := range src {
+		if strings.ToLower(k) == key {
+			return v, true
+		}
+	}
+
+	return nil, false
+}
+
+// Return JSON type name for Go type, for use in error messages.
+func typeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return typeName(t.Elem())
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.String:
+		return "string"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Map:
+		return "object"
+	case reflect.Struct:
+		if t == timeType {
+			return "timestamp"
+		}
+
+		return "object"
+	}
+
+	return t.String()
+}
+
+// Return JSON type name for generic value.
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+
+	return fmt.Sprintf("%T", v)
+}
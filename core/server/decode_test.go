@@ -0,0 +1,104 @@
+// Copyright 2012 - 2014 Alex Palaistras. All rights reserved.
+// Use of this source code is governed by the MIT License, the
+// full text of which can be found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type decodeInner struct {
+	Id int
+}
+
+type decodeParams struct {
+	decodeInner
+	Name    string `sleepy:"required"`
+	Tags    []string
+	Limits  map[string]uint8
+	Created time.Time
+	Ratio   *float64
+}
+
+func TestDecode(t *testing.T) {
+	ratio := 0.5
+
+	tests := []struct {
+		name   string
+		strict bool
+		src    string
+		want   interface{}
+		err    string
+	}{
+		{"int", true, `42`, int(42), ""},
+		{"int8 upper bound", true, `127`, int8(127), ""},
+		{"int8 lower bound", true, `-128`, int8(-128), ""},
+		{"int8 overflow", true, `128`, int8(0), "params: number 128 does not fit in int8"},
+		{"int8 underflow", true, `-129`, int8(0), "params: number -129 does not fit in int8"},
+		{"int64 overflow", true, `9223372036854775808`, int64(0), "does not fit in int64"},
+		{"int fraction", true, `1.5`, int(0), "does not fit in int"},
+		{"uint8 upper bound", true, `255`, uint8(255), ""},
+		{"uint8 overflow", true, `256`, uint8(0), "does not fit in uint8"},
+		{"uint negative", true, `-1`, uint(0), "does not fit in uint"},
+		{"uint64 overflow", true, `18446744073709551616`, uint64(0), "does not fit in uint64"},
+		{"int8 overflow, not strict", false, `128`, int8(0), ""},
+		{"uint negative, not strict", false, `-1`, uint(0), ""},
+		{"int fraction, not strict", false, `1.5`, int(0), ""},
+		{"float", true, `1.5`, float64(1.5), ""},
+		{"string", true, `"a"`, "a", ""},
+		{"string mismatch", true, `1`, "", "params: expected string, got number"},
+		{"string mismatch, not strict", false, `1`, "", ""},
+		{"bool", true, `true`, true, ""},
+		{"generic object", true, `{"a":[1]}`, map[string]interface{}{"a": []interface{}{1.0}}, ""},
+		{"time string", true, `"2014-01-02T03:04:05Z"`, time.Date(2014, 1, 2, 3, 4, 5, 0, time.UTC), ""},
+		{"time number", true, `1388631845`, time.Unix(1388631845, 0), ""},
+		{"time malformed", true, `"yesterday"`, time.Time{}, "params: expected RFC 3339 timestamp, got 'yesterday'"},
+		{"array", true, `[1,2]`, [2]int{1, 2}, ""},
+		{"array too long", true, `[1,2,3]`, [2]int{}, "params: expected at most 2 items, got 3"},
+		{
+			"struct", true,
+			`{"id":1,"NAME":"x","tags":["a"],"limits":{"rate":5},"ratio":0.5}`,
+			decodeParams{decodeInner: decodeInner{1}, Name: "x", Tags: []string{"a"}, Limits: map[string]uint8{"rate": 5}, Ratio: &ratio},
+			"",
+		},
+		{"struct unknown field", true, `{"name":"x","color":"red"}`, decodeParams{}, "params.color: unknown field"},
+		{"struct unknown field, not strict", false, `{"name":"x","color":"red"}`, decodeParams{Name: "x"}, ""},
+		{"struct missing required field", true, `{"id":1}`, decodeParams{}, "params.Name: required field is missing"},
+		{"struct nested mismatch", true, `{"name":"x","tags":["a",1]}`, decodeParams{}, "params.Tags[1]: expected string, got number"},
+		{"struct nested overflow", true, `{"name":"x","limits":{"rate":300}}`, decodeParams{}, "params.Limits.rate: number 300 does not fit in uint8"},
+		{"struct nested overflow, not strict", false, `{"name":"x","limits":{"rate":300}}`, decodeParams{Name: "x", Limits: map[string]uint8{"rate": 0}}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var src interface{}
+			if err := json.Unmarshal([]byte(tt.src), &src); err != nil {
+				t.Fatalf("invalid source '%s': %s", tt.src, err)
+			}
+
+			dest := reflect.New(reflect.TypeOf(tt.want)).Elem()
+			err := (&decoder{strict: tt.strict}).decode("params", src, dest)
+
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("decode(%s) returned error %v, want error containing '%s'", tt.src, err, tt.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("decode(%s) returned error: %s", tt.src, err)
+			}
+
+			if got := dest.Interface(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decode(%s) = %#v, want %#v", tt.src, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2012 - 2014 Alex Palaistras. All rights reserved.
+// Use of this source code is governed by the MIT License, the
+// full text of which can be found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"path"
+	"reflect"
+	"time"
+)
+
+// A JSON Schema document.
+type schema map[string]interface{}
+
+var (
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	timeType    = reflect.TypeOf(time.Time{})
+)
+
+// Describe returns a description of all modules and methods that can be called,
+// including the built-in methods under 'Sleepy'. Parameters and return values
+// for each method are described as JSON Schema, with named types placed under
+// 'definitions' and referred to by name.
+func Describe() map[string]interface{} {
+	defs := make(map[string]interface{})
+	modules := make(map[string]interface{})
+
+	for module := range methods {
+		desc := make(map[string]interface{})
+		for name, m := range methods[module] {
+			t := m.(reflect.Value).Type()
+			params := make([]interface{}, 0, t.NumIn())
+			for i := 0; i < t.NumIn(); i++ {
+				// Contexts are passed by the server, not the client.
+				if i == 0 && t.In(i) == contextType {
+					continue
+				}
+
+				params = append(params, describeType(t.In(i), defs))
+			}
+
+			var result interface{} = schema{}
+			if t.NumOut() > 0 && t.Out(0) != errorType {
+				result = describeType(t.Out(0), defs)
+			}
+
+			desc[name] = map[string]interface{}{"params": params, "result": result}
+		}
+
+		modules[module] = map[string]interface{}{"methods": desc}
+	}
+
+	// Describe methods on the Server receiver, which follow the conventions
+	// used in package 'net/rpc'.
+	desc := make(map[string]interface{})
+	t := reflect.TypeOf(&Server{})
+	for i := 0; i < t.NumMethod(); i++ {
+		m := t.Method(i)
+		desc[m.Name] = map[string]interface{}{
+			"params": []interface{}{describeType(m.Type.In(1), defs)},
+			"result": describeType(m.Type.In(2).Elem(), defs),
+		}
+	}
+
+	modules["Sleepy"] = map[string]interface{}{"methods": desc}
+
+	return map[string]interface{}{
+		"$schema":     "http://json-schema.org/draft-04/schema#",
+		"definitions": defs,
+		"modules":     modules,
+	}
+}
+
+// Describe returns a description of all modules and methods that can be called,
+// as returned by the package-level Describe function.
+func (s *Server) Describe(_ *struct{}, reply *interface{}) error {
+	*reply = Describe()
+	return nil
+}
+
+// Return JSON Schema for type 't', adding any named struct types encountered
+// to 'defs'.
+func describeType(t reflect.Type, defs map[string]interface{}) interface{} {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return describeType(t.Elem(), defs)
+	case reflect.Bool:
+		return schema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return schema{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return schema{"type": "number"}
+	case reflect.String:
+		return schema{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return schema{"type": "string"}
+		}
+
+		return schema{"type": "array", "items": describeType(t.Elem(), defs)}
+	case reflect.Map:
+		return schema{"type": "object", "additionalProperties": describeType(t.Elem(), defs)}
+	case reflect.Struct:
+		if t == timeType {
+			return schema{"type": "string", "format": "date-time"}
+		}
+
+		if t.Name() == "" {
+			return describeStruct(t, defs)
+		}
+
+		name := path.Base(t.PkgPath()) + "." + t.Name()
+		if _, exists := defs[name]; !exists {
+			// Reserve name before describing fields, in case of recursive types.
+			defs[name] = schema{}
+			defs[name] = describeStruct(t, defs)
+		}
+
+		return schema{"$ref": "#/definitions/" + name}
+	}
+
+	// Interfaces and any other types may hold arbitrary values.
+	return schema{}
+}
+
+// Return JSON Schema for struct type 't', describing its exported fields along
+// with fields promoted from embedded structs.
+func describeStruct(t reflect.Type, defs map[string]interface{}) schema {
+	var required []string
+	props := make(map[string]interface{})
+
+	for _, f := range reflect.VisibleFields(t) {
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+
+		// Skip unexported fields and embedded structs, whose fields are promoted.
+		if f.PkgPath != "" || (f.Anonymous && ft.Kind() == reflect.Struct) {
+			continue
+		}
+
+		props[f.Name] = describeType(f.Type, defs)
+		if isRequired(f) {
+			required = append(required, f.Name)
+		}
+	}
+
+	s := schema{"type": "object", "properties": props}
+	if required != nil {
+		s["required"] = required
+	}
+
+	if strict.Load() {
+		s["additionalProperties"] = false
+	}
+
+	return s
+}
@@ -0,0 +1,75 @@
+// Copyright 2012 - 2014 Alex Palaistras. All rights reserved.
+// Use of this source code is governed by the MIT License, the
+// full text of which can be found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Error codes returned to clients. The first set of codes is defined by the
+// JSON-RPC 2.0 specification, while the second set is specific to Sleepy. Codes
+// are stable, and modules are expected to return errors with the code best
+// describing the failure, via Errorf. Calls failing with codes 'Unavailable',
+// 'Timeout' or 'RateLimited' may succeed if retried.
+const (
+	ParseError     = -32700 // Request could not be parsed as JSON.
+	InvalidRequest = -32600 // Request is not a valid request object.
+	MethodNotFound = -32601 // Module or method does not exist.
+	InvalidParams  = -32602 // Parameters do not match the method signature, or are otherwise invalid.
+	InternalError  = -32603 // Server failed for reasons outside of the client's control.
+
+	ModuleError  = -32000 // Module method returned an error.
+	Unauthorized = -32001 // Authkey did not match any user.
+	Forbidden    = -32002 // User has not been granted permission to call method.
+	BatchError   = -32003 // Request in batch not run due to other requests failing.
+	Timeout      = -32004 // Call did not complete before its deadline.
+	NotFound     = -32005 // Resource requested does not exist.
+	Unavailable  = -32006 // Service the module depends on is unavailable.
+	RateLimited  = -32007 // User has exceeded limits set on calls.
+)
+
+// Error represents an error returned from an RPC call, and carries a numeric
+// code, which clients can use for differentiating between classes of errors,
+// a human-readable message and optional, arbitrary data.
+type Error struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// Error returns the message contained in Error.
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// WithData sets optional data for error, e.g. details on the parameter that
+// failed validation, and returns the error for convenience.
+func (e *Error) WithData(data interface{}) *Error {
+	e.Data = data
+	return e
+}
+
+// Errorf returns a new error with code 'code' and message formatted according
+// to format specifier and arguments.
+func Errorf(code int, format string, a ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+// Convert arbitrary error to *Error, treating any untyped error as having been
+// returned by a module method, unless caused by a context deadline passing.
+func toError(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return &Error{Code: Timeout, Message: err.Error()}
+	}
+
+	return &Error{Code: ModuleError, Message: err.Error()}
+}
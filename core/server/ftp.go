@@ -6,48 +6,56 @@ package server
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/deuill/sleepy/core/user"
 )
 
 type ftpSession struct {
-	conn net.Conn
-	data net.Listener
-	user *user.User
+	conn      net.Conn
+	data      net.Listener
+	user      *user.User
+	transfers sync.WaitGroup
 }
 
-func ServeFTP(addr string) error {
-	ln, err := net.Listen("tcp", addr)
-	if err != nil {
-		return err
-	}
-
+// ServeFTP accepts FTP connections on listener 'ln', returning when the
+// listener is closed. File transfers in progress are allowed to complete
+// before their session is closed.
+func ServeFTP(ln net.Listener) error {
 	defer ln.Close()
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+
 			continue
 		}
 
-		session := &ftpSession{conn, nil, nil}
+		session := &ftpSession{conn: conn}
 		go session.serve()
 	}
 }
 
 func (s *ftpSession) serve() {
+	track(s.conn)
+	defer untrack(s.conn)
+
 	buf := bufio.NewReader(s.conn)
 	s.respond("220 Connection established")
 
 	for {
 		line, err := buf.ReadString('\n')
 		if err != nil {
-			continue
+			goto quit
 		}
 
 		params := strings.Fields(line)
@@ -75,11 +83,11 @@ func (s *ftpSession) serve() {
 			s.respond("227 Entering Passive Mode (127,0,0,1," + p + ")")
 		case "USER":
 			if len(params) < 2 {
-				s.respond("501 USER expects an SHA1 authkey, none given")
+				s.respond("501 USER expects an authkey or signature, none given")
 				break
 			}
 
-			u, _ := user.Auth(params[1])
+			u, _ := s.login(params[1])
 			if u == nil {
 				s.respond("530 Login failed")
 				break
@@ -99,6 +107,7 @@ func (s *ftpSession) serve() {
 			}
 
 			s.respond("150 File transfer starting")
+			s.transfers.Add(1)
 			go s.storeFile(params[1])
 		case "QUIT":
 			s.respond("221 Closing connection")
@@ -113,14 +122,44 @@ quit:
 		s.data.Close()
 	}
 
+	s.transfers.Wait()
 	s.conn.Close()
 }
 
+// Authenticate user by the signature or authkey in 'credentials'. Signatures
+// are made as for RPC requests, for method 'FTP.Login' without parameters.
+// Users must be granted permission to call 'FTP.Login', as for module methods.
+func (s *ftpSession) login(credentials string) (*user.User, error) {
+	var u *user.User
+	var err error
+
+	if strings.Contains(credentials, ":") {
+		u, err = verify(credentials, "FTP.Login", nil)
+	} else if requireSigned.Load() {
+		return nil, fmt.Errorf("Logins must be signed.")
+	} else {
+		u, err = user.Auth(credentials)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if ok, err := u.Can("FTP", "Login"); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, fmt.Errorf("User is not permitted to log in via FTP.")
+	}
+
+	return u, nil
+}
+
 func (s *ftpSession) respond(msg string) {
 	fmt.Fprintln(s.conn, msg)
 }
 
 func (s *ftpSession) storeFile(name string) {
+	defer s.transfers.Done()
 	defer s.data.Close()
 
 	conn, err := s.data.Accept()
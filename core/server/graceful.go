@@ -0,0 +1,98 @@
+// Copyright 2012 - 2014 Alex Palaistras. All rights reserved.
+// Use of this source code is governed by the MIT License, the
+// full text of which can be found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Connections currently being served, along with a flag denoting whether the
+// server is shutting down.
+var active struct {
+	sync.Mutex
+	wg       sync.WaitGroup
+	conns    map[interface{}]bool
+	stopping bool
+}
+
+// Stop stops accepting new connections on all listeners opened via Listen and
+// waits for connections currently being served to finish processing in-flight
+// requests, or for the context to be done, whichever comes first. Idle
+// connections are closed immediately.
+func Stop(ctx context.Context) error {
+	closeListeners()
+
+	active.Lock()
+	active.stopping = true
+	for c := range active.conns {
+		drain(c)
+	}
+	active.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		active.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("Timed out waiting for connections to finish: %s", ctx.Err())
+	}
+}
+
+// Register connection 'c' as active until the matching call to 'untrack'. Stop
+// waits for all active connections to be untracked.
+func track(c interface{}) {
+	active.Lock()
+	defer active.Unlock()
+
+	if active.conns == nil {
+		active.conns = make(map[interface{}]bool)
+	}
+
+	active.conns[c] = true
+	active.wg.Add(1)
+
+	// Connections accepted just as the server is stopping are drained at once.
+	if active.stopping {
+		drain(c)
+	}
+}
+
+// Remove connection 'c' from the set of active connections.
+func untrack(c interface{}) {
+	active.Lock()
+	defer active.Unlock()
+
+	delete(active.conns, c)
+	active.wg.Done()
+}
+
+// Stop reading further requests from connection 'c', allowing requests already
+// read to complete.
+func drain(c interface{}) {
+	if d, ok := c.(interface {
+		SetReadDeadline(t time.Time) error
+	}); ok {
+		d.SetReadDeadline(time.Now())
+	}
+}
+
+// Stop reading further requests from connection 'c' if the server is stopping,
+// e.g. after deadlines set on the connection have been cleared.
+func redrain(c interface{}) {
+	active.Lock()
+	defer active.Unlock()
+
+	if active.stopping {
+		drain(c)
+	}
+}
@@ -5,9 +5,13 @@
 package server
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
 	"net/http"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 )
 
@@ -16,7 +20,7 @@ type fileHandler struct {
 }
 
 func HTTPHandler(root string) http.Handler {
-	return &fileHandler{root}
+	return measured("files", &fileHandler{root})
 }
 
 func (f *fileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -37,3 +41,106 @@ func (f *fileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	http.ServeFile(w, r, upath)
 }
+
+type rpcHandler struct {
+	maxBody int64
+}
+
+// RPCHandler returns a handler serving JSON-RPC 2.0 requests and batches over
+// HTTP, as an alternative to the raw TCP socket. Requests are sent via POST,
+// with the authkey for the calling user passed in the 'X-Sleepy-Authkey'
+// header. Request bodies larger than 'maxBody' bytes are rejected, unless
+// 'maxBody' is zero.
+func RPCHandler(maxBody int64) http.Handler {
+	return measured("rpc", &rpcHandler{maxBody})
+}
+
+func (h *rpcHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeResponse(w, http.StatusMethodNotAllowed, &rpcResponse{Error: Errorf(InvalidRequest, "Method not allowed, use POST instead")})
+		return
+	}
+
+	body := r.Body
+	if h.maxBody > 0 {
+		body = http.MaxBytesReader(w, r.Body, h.maxBody)
+	}
+
+	buf, err := ioutil.ReadAll(body)
+	if err != nil {
+		if _, ok := err.(*http.MaxBytesError); ok {
+			writeResponse(w, http.StatusRequestEntityTooLarge, &rpcResponse{Error: Errorf(InvalidRequest, "Request body exceeds %d bytes", h.maxBody)})
+			return
+		}
+
+		writeResponse(w, http.StatusBadRequest, &rpcResponse{Error: Errorf(InvalidRequest, "Could not read request body: %s", err)})
+		return
+	}
+
+	if !json.Valid(buf) {
+		writeResponse(w, http.StatusBadRequest, &rpcResponse{Error: Errorf(ParseError, "Parse error: request is not valid JSON")})
+		return
+	}
+
+	resp := handle(buf, &peer{authkey: r.Header.Get("X-Sleepy-Authkey"), ctx: r.Context()})
+	switch resp := resp.(type) {
+	case nil:
+		// Notifications receive no response body.
+		w.WriteHeader(http.StatusNoContent)
+	case *rpcResponse:
+		// Calls exceeding the rate allowed carry the time after which they may
+		// be retried, rounded up to the nearest second.
+		if resp.Error != nil && resp.Error.Code == RateLimited {
+			if data, ok := resp.Error.Data.(map[string]interface{}); ok && data["retry_after"] != nil {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(data["retry_after"].(float64)))))
+			}
+		}
+
+		writeResponse(w, httpStatus(resp.Error), resp)
+	default:
+		// Batches may contain mixed results, and are always successful at
+		// the HTTP level.
+		writeResponse(w, http.StatusOK, resp)
+	}
+}
+
+// Write response value as JSON, with the HTTP status code given.
+func writeResponse(w http.ResponseWriter, status int, resp interface{}) {
+	buf, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(buf)))
+	w.WriteHeader(status)
+	w.Write(buf)
+}
+
+// Returns HTTP status code corresponding to RPC error.
+func httpStatus(err *Error) int {
+	if err == nil {
+		return http.StatusOK
+	}
+
+	switch err.Code {
+	case ParseError, InvalidRequest, InvalidParams:
+		return http.StatusBadRequest
+	case Unauthorized:
+		return http.StatusUnauthorized
+	case Forbidden:
+		return http.StatusForbidden
+	case MethodNotFound, NotFound:
+		return http.StatusNotFound
+	case Unavailable:
+		return http.StatusServiceUnavailable
+	case Timeout:
+		return http.StatusGatewayTimeout
+	case RateLimited:
+		return http.StatusTooManyRequests
+	}
+
+	return http.StatusInternalServerError
+}
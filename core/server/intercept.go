@@ -0,0 +1,142 @@
+// Copyright 2012 - 2014 Alex Palaistras. All rights reserved.
+// Use of this source code is governed by the MIT License, the
+// full text of which can be found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"sync"
+
+	"github.com/deuill/sleepy/core/user"
+)
+
+// Call represents a single call to a module method, as passed to interceptors.
+type Call struct {
+	User   *user.User  // User is the authenticated user making the call.
+	Module string      // Module is the name of the module being called.
+	Method string      // Method is the name of the method being called.
+	Params interface{} // Params are the parameters for the call, as sent by the client.
+
+	// Context is cancelled when the call's deadline passes or the client
+	// disconnects, and is passed to module methods accepting a context.
+	Context context.Context
+
+	// Resources held for the call, e.g. against limits set for the user.
+	hold *hold
+}
+
+// Resources held for a call, released once the call returns, or once the module
+// method returns, for methods still running past the call's deadline.
+type hold struct {
+	sync.Mutex
+	release func()
+}
+
+// Return function releasing resources held, if not already taken, so that the
+// resources are released exactly once.
+func (h *hold) take() func() {
+	if h == nil {
+		return nil
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	release := h.release
+	h.release = nil
+
+	return release
+}
+
+// Run call through chain of interceptors, as for intercept, and release resources
+// held for the call once it returns, unless taken by the module method called.
+func perform(c *Call, method reflect.Value) (interface{}, error) {
+	defer func() {
+		if release := c.hold.take(); release != nil {
+			release()
+		}
+	}()
+
+	return intercept(c, method)
+}
+
+// Key for the user making a call, as stored in the context passed to methods.
+type callerKey struct{}
+
+// Caller returns the user making the call that 'ctx' was passed to, or nil if
+// 'ctx' was not passed to a module method by the server. Modules may use this in
+// place of authkeys passed in parameters, which signed requests need not carry.
+func Caller(ctx context.Context) *user.User {
+	u, _ := ctx.Value(callerKey{}).(*user.User)
+	return u
+}
+
+// Handler handles a call to a module method, returning its result.
+type Handler func(c *Call) (interface{}, error)
+
+// Interceptor wraps calls to module methods. Interceptors may inspect or modify
+// the call before passing it on to 'next', return early without calling 'next',
+// or inspect and modify the result returned by 'next'.
+type Interceptor func(c *Call, next Handler) (interface{}, error)
+
+// Chain of interceptors run around every call to a module method.
+var interceptors []Interceptor
+
+// Intercept adds interceptor to the chain run around every call to a module
+// method. Interceptors are called in the order they were added, after the user
+// has been authenticated and permissions checked, but before any parameters are
+// decoded. Interceptors are to be added before the server starts, usually in a
+// package's init function.
+func Intercept(i Interceptor) {
+	interceptors = append(interceptors, i)
+}
+
+// Run call through chain of interceptors, with 'method' called at the end of
+// the chain.
+func intercept(c *Call, method reflect.Value) (interface{}, error) {
+	h := func(c *Call) (interface{}, error) {
+		return invoke(c, method)
+	}
+
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		next, fn := h, interceptors[i]
+		h = func(c *Call) (interface{}, error) {
+			return fn(c, next)
+		}
+	}
+
+	return h(c)
+}
+
+// Rejection is notified of calls rejected before reaching a module method, e.g.
+// for failing authentication or exceeding limits set for the user, along with
+// the error returned to the client. The user for calls is nil if the user could
+// not be authenticated.
+type Rejection func(c *Call, err *Error)
+
+// Functions notified of rejected calls.
+var rejections []Rejection
+
+// OnReject adds function to be notified of rejected calls. Functions are called
+// in the order they were added, synchronously with the call, and are to be added
+// before the server starts, usually in a package's init function.
+func OnReject(r Rejection) {
+	rejections = append(rejections, r)
+}
+
+// Count call for request 'req', made by user 'u', if authenticated, as rejected
+// with error 'err', notify functions added with OnReject, and return error for
+// convenience.
+func reject(req *Request, u *user.User, err *Error) *Error {
+	callsRejected.Inc(strconv.Itoa(err.Code))
+
+	c := &Call{u, req.Module, req.Method, req.Params, req.ctx, nil}
+	for _, fn := range rejections {
+		fn(c, err)
+	}
+
+	return err
+}
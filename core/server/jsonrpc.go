@@ -0,0 +1,374 @@
+// Copyright 2012 - 2014 Alex Palaistras. All rights reserved.
+// Use of this source code is governed by the MIT License, the
+// full text of which can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deuill/sleepy/core/user"
+)
+
+// Time allowed for clients connecting over TLS to complete the handshake.
+const handshakeTimeout = 10 * time.Second
+
+// A JSON-RPC request, as sent by the client. Requests following version 2.0
+// of the specification carry the module and method name in 'method' (e.g.
+// 'Database.Get'), the user's authkey in the non-standard 'auth' member or
+// the request signature in 'signature' and, optionally, the time allowed for
+// the call in seconds in 'timeout'.
+// Version 1.0 requests carry a single parameter for the 'Sleepy.Call' and
+// 'Sleepy.CallMany' methods, which contains the authkey.
+type rpcRequest struct {
+	Version   string          `json:"jsonrpc"`
+	Method    string          `json:"method"`
+	Params    json.RawMessage `json:"params"`
+	Id        json.RawMessage `json:"id"`
+	Auth      string          `json:"auth"`
+	Signature string          `json:"signature"`
+	Timeout   float64         `json:"timeout"`
+}
+
+// A JSON-RPC 2.0 response, containing either a result or an error.
+type rpcResponse struct {
+	Result interface{}
+	Error  *Error
+	Id     json.RawMessage
+}
+
+func (r *rpcResponse) MarshalJSON() ([]byte, error) {
+	if r.Error != nil {
+		return json.Marshal(struct {
+			Version string          `json:"jsonrpc"`
+			Error   *Error          `json:"error"`
+			Id      json.RawMessage `json:"id"`
+		}{"2.0", r.Error, r.Id})
+	}
+
+	return json.Marshal(struct {
+		Version string          `json:"jsonrpc"`
+		Result  interface{}     `json:"result"`
+		Id      json.RawMessage `json:"id"`
+	}{"2.0", r.Result, r.Id})
+}
+
+// The client on the other end of a connection, along with credentials used for
+// requests not carrying an authkey of their own.
+type peer struct {
+	authkey string          // Authkey passed alongside requests, e.g. in HTTP headers.
+	user    *user.User      // User authenticated by TLS client certificate.
+	ctx     context.Context // Context cancelled when the client disconnects.
+
+	// Calls made by the client, waited for before the connection is closed.
+	calls *sync.WaitGroup
+}
+
+// Set context for request 'r', and credentials unless it carries an authkey or
+// signature of its own.
+func (p *peer) authorize(r *Request) {
+	if p == nil {
+		return
+	}
+
+	r.ctx, r.calls = p.ctx, p.calls
+	if r.Authkey == "" && r.Signature == "" {
+		r.Authkey, r.user = p.authkey, p.user
+	}
+}
+
+// A JSON-RPC 1.0 response, where errors are returned as plain strings. The code
+// for errors is returned in the non-standard 'code' member.
+type legacyResponse struct {
+	Id     json.RawMessage `json:"id"`
+	Result interface{}     `json:"result"`
+	Error  interface{}     `json:"error"`
+	Code   int             `json:"code,omitempty"`
+}
+
+// ServeConn serves JSON-RPC requests on a single connection until the client
+// hangs up. Requests are handled concurrently, and responses are written back
+// in the order they complete. Both JSON-RPC 2.0 requests, including batches
+// and notifications, and JSON-RPC 1.0 requests for 'Sleepy.Call' and
+// 'Sleepy.CallMany' are accepted on the same connection.
+//
+// When the server is stopping, no further requests are read from connections
+// supporting read deadlines, and the connection is closed once all in-flight
+// requests have completed.
+//
+// Clients connecting over TLS and presenting a verified certificate with a
+// subject associated with a user are authenticated as that user, and may omit
+// the authkey from requests.
+func ServeConn(conn io.ReadWriteCloser) {
+	var mutex sync.Mutex
+	var wg, calls sync.WaitGroup
+
+	track(conn)
+	defer untrack(conn)
+
+	// Calls in progress are cancelled if the client hangs up.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p := &peer{ctx: ctx, calls: &calls}
+	if c, ok := conn.(*tls.Conn); ok {
+		// Clients are not allowed to hold connections open indefinitely by
+		// stalling the handshake.
+		c.SetDeadline(time.Now().Add(handshakeTimeout))
+		if err := c.Handshake(); err != nil {
+			conn.Close()
+			return
+		}
+
+		c.SetDeadline(time.Time{})
+		redrain(c)
+
+		// Certificates are only present if verified against the client CA.
+		if certs := c.ConnectionState().PeerCertificates; len(certs) > 0 {
+			p.user, _ = user.AuthCertificate(certs[0].Subject.String())
+		}
+	}
+
+	dec := json.NewDecoder(conn)
+	enc := json.NewEncoder(conn)
+
+	for {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			// A malformed request leaves the stream in an unknown state, so we
+			// respond with an error and hang up.
+			if _, ok := err.(*json.SyntaxError); ok {
+				mutex.Lock()
+				enc.Encode(&rpcResponse{Error: Errorf(ParseError, "Parse error: %s", err)})
+				mutex.Unlock()
+			} else if e, ok := err.(net.Error); !ok || !e.Timeout() {
+				// Reads time out when the server is stopping, in which case
+				// calls are allowed to complete.
+				cancel()
+			}
+
+			break
+		}
+
+		wg.Add(1)
+		go func(raw json.RawMessage) {
+			defer wg.Done()
+
+			if resp := handle(raw, p); resp != nil {
+				mutex.Lock()
+				enc.Encode(resp)
+				mutex.Unlock()
+			}
+		}(raw)
+	}
+
+	// Module methods still running past their deadline hold the connection
+	// open, so that they count against the connections allowed.
+	wg.Wait()
+	calls.Wait()
+	conn.Close()
+}
+
+// Handle single request or batch of requests in 'raw', returning a response
+// value to be encoded or nil, if no response is to be sent. Requests not
+// carrying an authkey of their own use the credentials in 'auth'.
+func handle(raw json.RawMessage, auth *peer) interface{} {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || raw[0] != '[' {
+		return handleOne(raw, auth)
+	}
+
+	// Handle batch request, each request of which is processed in turn.
+	var batch []json.RawMessage
+	if err := json.Unmarshal(raw, &batch); err != nil || len(batch) == 0 {
+		return &rpcResponse{Error: Errorf(InvalidRequest, "Invalid request: batch is empty")}
+	}
+
+	responses := make([]interface{}, 0, len(batch))
+	for _, r := range batch {
+		if resp := handleOne(r, auth); resp != nil {
+			responses = append(responses, resp)
+		}
+	}
+
+	// A batch consisting solely of notifications receives no response.
+	if len(responses) == 0 {
+		return nil
+	}
+
+	return responses
+}
+
+// Handle single request, returning nil for notifications.
+func handleOne(raw json.RawMessage, auth *peer) interface{} {
+	var req rpcRequest
+	if err := json.Unmarshal(raw, &req); err != nil {
+		// Attempt to recover the request id, if any, for the error response.
+		var r struct{ Id json.RawMessage }
+		json.Unmarshal(raw, &r)
+
+		return &rpcResponse{Error: Errorf(InvalidRequest, "Invalid request: %s", err), Id: r.Id}
+	}
+
+	if req.Version == "" && req.Method != "" {
+		return handleLegacy(&req, auth)
+	}
+
+	if req.Version != "2.0" || req.Method == "" {
+		return &rpcResponse{Error: Errorf(InvalidRequest, "Invalid request"), Id: req.Id}
+	}
+
+	result, err := dispatch(&req, auth)
+
+	// Notifications are requests without an id, and receive no response,
+	// even on error.
+	if len(req.Id) == 0 {
+		return nil
+	}
+
+	if err != nil {
+		return &rpcResponse{Error: toError(err), Id: req.Id}
+	}
+
+	return &rpcResponse{Result: result, Id: req.Id}
+}
+
+// Dispatch JSON-RPC 2.0 request to module method, or to methods on the Server
+// receiver for methods under 'Sleepy'.
+func dispatch(req *rpcRequest, auth *peer) (interface{}, error) {
+	n := strings.Index(req.Method, ".")
+	if n <= 0 || n == len(req.Method)-1 {
+		return nil, Errorf(MethodNotFound, "Method '%s' does not exist.", req.Method)
+	}
+
+	if req.Method[:n] == "Sleepy" {
+		if req.Auth != "" {
+			p := &peer{authkey: req.Auth}
+			if auth != nil {
+				p.ctx, p.calls = auth.ctx, auth.calls
+			}
+
+			auth = p
+		}
+
+		return builtin(req.Method, req.Params, req.Signature, auth)
+	}
+
+	var params interface{}
+	if len(req.Params) > 0 {
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, Errorf(InvalidParams, "Invalid parameters: %s", err)
+		}
+	}
+
+	r := &Request{
+		Module:    req.Method[:n],
+		Method:    req.Method[n+1:],
+		Authkey:   req.Auth,
+		Signature: req.Signature,
+		Params:    params,
+		Timeout:   req.Timeout,
+	}
+
+	auth.authorize(r)
+	return call(r)
+}
+
+// Handle JSON-RPC 1.0 request for methods on the Server receiver, returning nil
+// for notifications, which are requests with a null id.
+func handleLegacy(req *rpcRequest, auth *peer) interface{} {
+	var result interface{}
+	var err error
+	var params []json.RawMessage
+
+	if err = json.Unmarshal(req.Params, &params); err != nil || len(params) != 1 {
+		err = Errorf(InvalidParams, "Method '%s' expects a single parameter.", req.Method)
+	} else {
+		result, err = builtin(req.Method, params[0], "", auth)
+	}
+
+	if len(req.Id) == 0 || string(req.Id) == "null" {
+		return nil
+	}
+
+	if err != nil {
+		e := toError(err)
+		return &legacyResponse{Id: req.Id, Error: e.Message, Code: e.Code}
+	}
+
+	return &legacyResponse{Id: req.Id, Result: result}
+}
+
+// Call method on the Server receiver with parameter in 'param'. Requests not
+// carrying an authkey of their own use the credentials in 'auth'. Methods other
+// than 'Sleepy.Call' and 'Sleepy.CallMany' are authenticated by 'signature',
+// or by credentials in 'param' or 'auth', and users must be granted permission
+// to call them, as with module methods.
+func builtin(method string, param json.RawMessage, signature string, auth *peer) (interface{}, error) {
+	var result interface{}
+	var err error
+
+	s := &Server{}
+
+	switch method {
+	case "Sleepy.Call":
+		var r Request
+		if err = json.Unmarshal(param, &r); err != nil {
+			return nil, Errorf(InvalidParams, "Invalid parameters: %s", err)
+		}
+
+		auth.authorize(&r)
+		err = s.Call(&r, &result)
+	case "Sleepy.CallMany":
+		var b Batch
+		if err = json.Unmarshal(param, &b); err != nil {
+			return nil, Errorf(InvalidParams, "Invalid parameters: %s", err)
+		} else if err = b.check(); err != nil {
+			return nil, err
+		}
+
+		for _, r := range b.Requests {
+			auth.authorize(r)
+		}
+
+		err = s.CallMany(&b, &result)
+	case "Sleepy.Describe", "Sleepy.Health":
+		// Credentials are carried in the parameter, if an object, as for
+		// 'Sleepy.Call', and requests are signed without parameters.
+		r := Request{Signature: signature}
+		if len(param) > 0 && param[0] == '{' {
+			if err = json.Unmarshal(param, &r); err != nil {
+				return nil, Errorf(InvalidParams, "Invalid parameters: %s", err)
+			}
+		}
+
+		r.Module, r.Method, r.Params = "Sleepy", strings.TrimPrefix(method, "Sleepy."), nil
+		auth.authorize(&r)
+
+		if u, e := authenticate(&r); e != nil {
+			return nil, reject(&r, u, e)
+		}
+
+		if r.Method == "Describe" {
+			err = s.Describe(nil, &result)
+		} else {
+			err = s.Health(nil, &result)
+		}
+	default:
+		return nil, Errorf(MethodNotFound, "Method '%s' does not exist.", method)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
@@ -0,0 +1,234 @@
+// Copyright 2012 - 2014 Alex Palaistras. All rights reserved.
+// Use of this source code is governed by the MIT License, the
+// full text of which can be found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/deuill/sleepy/core/config"
+	"github.com/deuill/sleepy/core/user"
+)
+
+// Time for which limits set for a user are cached before being loaded again.
+const limitsTTL = 10 * time.Second
+
+// Limits on calls made by a user, either to all methods, to methods in a single
+// module or to a single method. Zero values denote no limit.
+type limits struct {
+	rate        float64 // Calls allowed per second, on average.
+	burst       float64 // Calls allowed in quick succession, above the average rate.
+	concurrency int     // Calls allowed to run at the same time.
+}
+
+// Token bucket for limits on calls, along with the number of calls running.
+type bucket struct {
+	tokens float64
+	last   time.Time
+	active int
+}
+
+// Limits set for a user, keyed by scope, i.e. '*' for all methods, the module
+// name (e.g. 'Database') or the fully-qualified method name (e.g. 'Database.Get').
+type userLimits struct {
+	scopes map[string]limits
+	loaded time.Time
+}
+
+// Limits in effect and buckets for each user and scope limited, along with
+// the default limits for users without limits of their own. Calls waiting for
+// others to complete are signalled by closing 'released' whenever a call does.
+var limiter struct {
+	sync.Mutex
+	defaults limits
+	users    map[int]*userLimits
+	buckets  map[string]*bucket
+	released chan struct{}
+}
+
+// Set default limits on calls to all methods from the '[limits]' section in
+// 'conf'. Limits loaded for users are dropped, and are loaded again as needed.
+func setLimits(conf *config.Config) {
+	limiter.Lock()
+	defer limiter.Unlock()
+
+	limiter.defaults = readLimits(conf, "limits")
+	limiter.users = make(map[int]*userLimits)
+	limiter.buckets = make(map[string]*bucket)
+}
+
+// Acquire permission for user 'u' to call method requested in 'req', according
+// to limits set for the user, or the default limits. The function returned is
+// to be called once the call completes. Calls exceeding the rate allowed fail
+// with a hint of the time after which they may be retried, in seconds.
+func acquire(u *user.User, req *Request) (func(), error) {
+	release, err, _ := take(u, req)
+	if err != nil {
+		return nil, reject(req, u, err)
+	}
+
+	return release, nil
+}
+
+// Acquire permission as for acquire, but wait for other calls to complete while
+// the number of calls running is at the limit, until 'ctx' is done. Calls
+// exceeding the rate allowed fail without waiting.
+func await(ctx context.Context, u *user.User, req *Request) (func(), error) {
+	for {
+		release, err, busy := take(u, req)
+		if err == nil {
+			return release, nil
+		} else if busy == nil {
+			return nil, reject(req, u, err)
+		}
+
+		select {
+		case <-busy:
+		case <-ctx.Done():
+			return nil, reject(req, u, err)
+		}
+	}
+}
+
+// Count call for method requested in 'req' by user 'u' against limits applying
+// to it, returning the function releasing the call once complete. Calls failing
+// only due to the number of calls running are returned a channel closed once a
+// call completes, after which they may be tried again.
+func take(u *user.User, req *Request) (func(), *Error, <-chan struct{}) {
+	scopes := loadLimits(u)
+
+	limiter.Lock()
+	defer limiter.Unlock()
+
+	now := time.Now()
+	buckets := make(map[*bucket]limits, 3)
+
+	// Check all limits applying to call before counting it against any.
+	var err *Error
+	var busy <-chan struct{}
+	for _, scope := range []string{"*", req.Module, req.Module + "." + req.Method} {
+		l, exists := scopes[scope]
+		if !exists {
+			continue
+		}
+
+		key := strconv.Itoa(u.Id) + "/" + scope
+		b, exists := limiter.buckets[key]
+		if !exists {
+			b = &bucket{tokens: l.burst, last: now}
+			limiter.buckets[key] = b
+		}
+
+		if l.rate > 0 {
+			b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+			b.last = now
+
+			if b.tokens < 1 {
+				wait := (1 - b.tokens) / l.rate
+				err = Errorf(RateLimited, "Rate limit exceeded for '%s', retry after %.2f seconds.", scope, wait).WithData(map[string]interface{}{
+					"retry_after": wait,
+				})
+
+				break
+			}
+		}
+
+		if l.concurrency > 0 && b.active >= l.concurrency {
+			if limiter.released == nil {
+				limiter.released = make(chan struct{})
+			}
+
+			err = Errorf(RateLimited, "Limit of %d concurrent calls exceeded for '%s'.", l.concurrency, scope)
+			busy = limiter.released
+			break
+		}
+
+		buckets[b] = l
+	}
+
+	if err != nil {
+		return nil, err, busy
+	}
+
+	for b, l := range buckets {
+		if l.rate > 0 {
+			b.tokens--
+		}
+
+		b.active++
+	}
+
+	return func() {
+		limiter.Lock()
+		defer limiter.Unlock()
+
+		for b := range buckets {
+			b.active--
+		}
+
+		if limiter.released != nil {
+			close(limiter.released)
+			limiter.released = nil
+		}
+	}, nil, nil
+}
+
+// Return limits set for user 'u', keyed by scope, loading limits from the user's
+// configuration if not loaded recently. Limits are set in the 'limits' module,
+// with section names denoting the scope and options 'rate', 'burst' and
+// 'concurrency' denoting the limits.
+func loadLimits(u *user.User) map[string]limits {
+	limiter.Lock()
+	ul, exists := limiter.users[u.Id]
+	defaults := limiter.defaults
+	limiter.Unlock()
+
+	if exists && time.Since(ul.loaded) < limitsTTL {
+		return ul.scopes
+	}
+
+	ul = &userLimits{scopes: make(map[string]limits), loaded: time.Now()}
+	if defaults != (limits{}) {
+		ul.scopes["*"] = defaults
+	}
+
+	if conf, err := u.Conf("limits"); err == nil {
+		for scope := range *conf {
+			if l := readLimits(conf, scope); l != (limits{}) {
+				ul.scopes[scope] = l
+			}
+		}
+	}
+
+	limiter.Lock()
+	if limiter.users == nil {
+		limiter.users = make(map[int]*userLimits)
+		limiter.buckets = make(map[string]*bucket)
+	}
+
+	limiter.users[u.Id] = ul
+	limiter.Unlock()
+
+	return ul.scopes
+}
+
+// Read limits from 'section' in 'conf'. The burst allowed is never lower than a
+// single call, or than the rate allowed, if not set.
+func readLimits(conf *config.Config, section string) limits {
+	l := limits{
+		rate:        conf.F(section, "rate"),
+		burst:       conf.F(section, "burst"),
+		concurrency: int(conf.I(section, "concurrency")),
+	}
+
+	if l.rate > 0 && l.burst < 1 {
+		l.burst = math.Max(1, l.rate)
+	}
+
+	return l
+}
@@ -0,0 +1,193 @@
+// Copyright 2012 - 2014 Alex Palaistras. All rights reserved.
+// Use of this source code is governed by the MIT License, the
+// full text of which can be found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deuill/sleepy/core/user"
+)
+
+// Set limits for user with id 'id' as if loaded from the user's configuration,
+// and drop all buckets.
+func setUserLimits(id int, scopes map[string]limits) {
+	limiter.Lock()
+	defer limiter.Unlock()
+
+	limiter.users = map[int]*userLimits{id: {scopes: scopes, loaded: time.Now()}}
+	limiter.buckets = make(map[string]*bucket)
+}
+
+// Return request for fully-qualified method name in 'method'.
+func limitRequest(method string) *Request {
+	n := strings.Index(method, ".")
+	return &Request{Module: method[:n], Method: method[n+1:]}
+}
+
+func TestAcquire(t *testing.T) {
+	tests := []struct {
+		name   string
+		scopes map[string]limits
+		calls  []string
+		want   []bool
+	}{
+		{
+			"no limits", nil,
+			[]string{"Database.Get", "Database.Get", "Database.Get"},
+			[]bool{true, true, true},
+		},
+		{
+			"concurrency for all methods", map[string]limits{"*": {concurrency: 2}},
+			[]string{"Database.Get", "File.Get", "Image.Crop"},
+			[]bool{true, true, false},
+		},
+		{
+			"concurrency for module", map[string]limits{"Database": {concurrency: 1}},
+			[]string{"Database.Get", "File.Get", "Database.Set"},
+			[]bool{true, true, false},
+		},
+		{
+			"concurrency for method", map[string]limits{"Database.Get": {concurrency: 1}},
+			[]string{"Database.Get", "Database.Get", "Database.Set"},
+			[]bool{true, false, true},
+		},
+		{
+			"rate with burst", map[string]limits{"*": {rate: 1, burst: 2}},
+			[]string{"Database.Get", "File.Get", "Database.Get"},
+			[]bool{true, true, false},
+		},
+		{
+			"limits for all scopes applying", map[string]limits{"*": {concurrency: 3}, "File.Get": {concurrency: 1}},
+			[]string{"File.Get", "File.Get", "Database.Get", "Database.Get", "Database.Get"},
+			[]bool{true, false, true, true, false},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &user.User{Id: 1}
+			setUserLimits(u.Id, tt.scopes)
+
+			for i, method := range tt.calls {
+				release, err := acquire(u, limitRequest(method))
+				if ok := err == nil; ok != tt.want[i] {
+					t.Fatalf("call #%d to '%s' allowed = %v, want %v (error: %v)", i, method, ok, tt.want[i], err)
+				} else if ok {
+					defer release()
+				} else if code := toError(err).Code; code != RateLimited {
+					t.Fatalf("call #%d to '%s' failed with code %d, want %d", i, method, code, RateLimited)
+				}
+			}
+		})
+	}
+}
+
+func TestAcquireRelease(t *testing.T) {
+	u := &user.User{Id: 1}
+	setUserLimits(u.Id, map[string]limits{"*": {concurrency: 1}})
+
+	release, err := acquire(u, limitRequest("Database.Get"))
+	if err != nil {
+		t.Fatalf("first call failed: %s", err)
+	}
+
+	if _, err = acquire(u, limitRequest("Database.Get")); err == nil {
+		t.Fatalf("second call allowed while first is running")
+	}
+
+	release()
+	if release, err = acquire(u, limitRequest("Database.Get")); err != nil {
+		t.Fatalf("call failed after first call completed: %s", err)
+	}
+
+	release()
+}
+
+func TestAcquireRefill(t *testing.T) {
+	u := &user.User{Id: 1}
+	setUserLimits(u.Id, map[string]limits{"*": {rate: 2, burst: 1}})
+
+	release, err := acquire(u, limitRequest("Database.Get"))
+	if err != nil {
+		t.Fatalf("first call failed: %s", err)
+	}
+
+	release()
+
+	_, err = acquire(u, limitRequest("Database.Get"))
+	if err == nil {
+		t.Fatalf("second call allowed before bucket was refilled")
+	}
+
+	data, _ := toError(err).Data.(map[string]interface{})
+	if wait, _ := data["retry_after"].(float64); wait <= 0 || wait > 0.5 {
+		t.Fatalf("retry hint is %v seconds, want between 0 and 0.5", data["retry_after"])
+	}
+
+	// Move the time the bucket was last filled back, as if time had passed.
+	limiter.Lock()
+	limiter.buckets["1/*"].last = limiter.buckets["1/*"].last.Add(-500 * time.Millisecond)
+	limiter.Unlock()
+
+	if release, err = acquire(u, limitRequest("Database.Get")); err != nil {
+		t.Fatalf("call failed after bucket was refilled: %s", err)
+	}
+
+	release()
+}
+
+func TestAwait(t *testing.T) {
+	u := &user.User{Id: 1}
+	setUserLimits(u.Id, map[string]limits{"*": {concurrency: 1}})
+
+	release, err := acquire(u, limitRequest("Database.Get"))
+	if err != nil {
+		t.Fatalf("first call failed: %s", err)
+	}
+
+	// Calls waiting past their deadline fail as if not waiting at all.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err = await(ctx, u, limitRequest("Database.Get")); err == nil || toError(err).Code != RateLimited {
+		t.Fatalf("waiting call returned error %v after deadline, want rate limit error", err)
+	}
+
+	// Calls waiting are allowed as soon as running calls complete.
+	done := make(chan error, 1)
+	go func() {
+		release, err := await(context.Background(), u, limitRequest("Database.Get"))
+		if err == nil {
+			release()
+		}
+
+		done <- err
+	}()
+
+	select {
+	case err = <-done:
+		t.Fatalf("waiting call returned before first call completed, with error %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	release()
+	if err = <-done; err != nil {
+		t.Fatalf("waiting call failed after first call completed: %s", err)
+	}
+
+	// Calls exceeding the rate allowed fail without waiting.
+	setUserLimits(u.Id, map[string]limits{"*": {rate: 1, burst: 1}})
+	if release, err = acquire(u, limitRequest("Database.Get")); err != nil {
+		t.Fatalf("call failed: %s", err)
+	}
+
+	release()
+	if _, err = await(context.Background(), u, limitRequest("Database.Get")); err == nil {
+		t.Fatalf("waiting call allowed beyond rate")
+	}
+}
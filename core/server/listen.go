@@ -0,0 +1,277 @@
+// Copyright 2012 - 2014 Alex Palaistras. All rights reserved.
+// Use of this source code is governed by the MIT License, the
+// full text of which can be found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Environment variables used for passing listening sockets to a new process.
+// Sockets are passed as file descriptors starting from 3, in the order their
+// names are listed, while the parent's PID is used for signalling when the new
+// process is ready to accept connections. Names of Unix domain sockets created
+// by us, rather than systemd, are listed separately.
+const (
+	listenersEnv = "SLEEPY_LISTENERS"
+	ownedEnv     = "SLEEPY_OWNED"
+	parentEnv    = "SLEEPY_PARENT"
+)
+
+// Listeners opened via Listen, keyed by name, as well as those inherited from a
+// parent process or systemd and not yet claimed. Unix domain sockets created by
+// us, and which are to be removed on close, are marked as owned.
+var listeners struct {
+	sync.Mutex
+	once      sync.Once
+	names     []string
+	open      map[string]net.Listener
+	inherited map[string]net.Listener
+	owned     map[string]bool
+}
+
+// Listen opens a listener named 'name' on address 'addr', which is either a TCP
+// address (e.g. '127.0.0.1:6006') or the path to a Unix domain socket prefixed
+// with 'unix:' (e.g. 'unix:/run/sleepy/sleepy.sock'). Stale socket files left
+// behind by processes no longer running are removed.
+//
+// Listeners passed down from a parent process via Handover, or by systemd via
+// socket activation, are reused instead of opening new sockets. These are
+// matched by name, which for systemd is set in the 'FileDescriptorName' option,
+// or by address for sockets passed by systemd without a name. All listeners are
+// closed when Stop is called.
+func Listen(name, addr string) (net.Listener, error) {
+	listeners.once.Do(inherit)
+
+	listeners.Lock()
+	defer listeners.Unlock()
+
+	if _, exists := listeners.open[name]; exists {
+		return nil, fmt.Errorf("Listener '%s' is already open.", name)
+	}
+
+	network := "tcp"
+	if strings.HasPrefix(addr, "unix:") {
+		network, addr = "unix", strings.TrimPrefix(addr, "unix:")
+	}
+
+	key := name
+	ln, exists := listeners.inherited[key]
+	if !exists {
+		key = network + ":" + addr
+		ln, exists = listeners.inherited[key]
+	}
+
+	if exists {
+		delete(listeners.inherited, key)
+		if listeners.owned[key] {
+			delete(listeners.owned, key)
+			listeners.owned[name] = true
+		}
+	} else {
+		if network == "unix" {
+			removeStale(addr)
+			listeners.owned[name] = true
+		}
+
+		var err error
+		if ln, err = net.Listen(network, addr); err != nil {
+			return nil, err
+		}
+	}
+
+	listeners.names = append(listeners.names, name)
+	listeners.open[name] = ln
+
+	return ln, nil
+}
+
+// Ready is to be called once all listeners have been opened and the server is
+// ready to accept connections. Any listeners inherited and not claimed via
+// Listen are closed, systemd is notified of the server's readiness, if running
+// under systemd, and the parent process, if any, is asked to shut down.
+func Ready() error {
+	listeners.once.Do(inherit)
+
+	listeners.Lock()
+	for key, ln := range listeners.inherited {
+		ln.Close()
+		delete(listeners.inherited, key)
+	}
+	listeners.Unlock()
+
+	// Notify systemd of our PID, as we may have taken over from the process
+	// it started.
+	if err := notify("READY=1\nMAINPID=" + strconv.Itoa(os.Getpid())); err != nil {
+		return fmt.Errorf("Unable to notify systemd: %s", err)
+	}
+
+	ppid, _ := strconv.Atoi(os.Getenv(parentEnv))
+	os.Unsetenv(parentEnv)
+
+	// Only signal the parent process if it is still the one that started us.
+	if ppid > 0 && ppid == os.Getppid() {
+		if err := syscall.Kill(ppid, syscall.SIGTERM); err != nil {
+			return fmt.Errorf("Unable to signal parent process: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// Handover starts a new copy of the running program, with the same arguments,
+// passing down all listeners opened via Listen. The new process is expected to
+// call Listen for the listeners it requires and Ready when it is able to accept
+// connections, at which point the current process receives a SIGTERM signal.
+// Both processes accept connections on the same sockets until then.
+func Handover() (*os.Process, error) {
+	listeners.Lock()
+	defer listeners.Unlock()
+
+	files := []*os.File{os.Stdin, os.Stdout, os.Stderr}
+	defer func() {
+		for _, f := range files[3:] {
+			f.Close()
+		}
+	}()
+
+	for _, name := range listeners.names {
+		ln, ok := listeners.open[name].(interface {
+			File() (*os.File, error)
+		})
+
+		if !ok {
+			return nil, fmt.Errorf("Listener '%s' cannot be passed to new process.", name)
+		}
+
+		f, err := ln.File()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to pass listener '%s' to new process: %s", name, err)
+		}
+
+		files = append(files, f)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	var env, owned []string
+	for _, e := range os.Environ() {
+		if n := strings.Index(e, "="); n > 0 {
+			switch e[:n] {
+			case listenersEnv, ownedEnv, parentEnv:
+				continue
+			}
+		}
+
+		env = append(env, e)
+	}
+
+	for _, name := range listeners.names {
+		if listeners.owned[name] {
+			owned = append(owned, name)
+		}
+	}
+
+	env = append(env, listenersEnv+"="+strings.Join(listeners.names, ","))
+	env = append(env, ownedEnv+"="+strings.Join(owned, ","))
+	env = append(env, parentEnv+"="+strconv.Itoa(os.Getpid()))
+
+	p, err := os.StartProcess(exe, os.Args, &os.ProcAttr{Env: env, Files: files})
+	if err != nil {
+		return nil, err
+	}
+
+	// Socket files are now shared with the new process, and are not to be
+	// removed when closing our listeners.
+	for _, ln := range listeners.open {
+		if u, ok := ln.(*net.UnixListener); ok {
+			u.SetUnlinkOnClose(false)
+		}
+	}
+
+	return p, nil
+}
+
+// Close all listeners opened via Listen.
+func closeListeners() {
+	listeners.Lock()
+	defer listeners.Unlock()
+
+	for _, name := range listeners.names {
+		listeners.open[name].Close()
+	}
+}
+
+// Load listeners passed down from parent process or systemd, if any.
+func inherit() {
+	listeners.open = make(map[string]net.Listener)
+	listeners.inherited = make(map[string]net.Listener)
+	listeners.owned = make(map[string]bool)
+
+	names, owned := os.Getenv(listenersEnv), os.Getenv(ownedEnv)
+	os.Unsetenv(listenersEnv)
+	os.Unsetenv(ownedEnv)
+
+	if names == "" {
+		for fd, name := range systemdListeners() {
+			addListener(fd, name)
+		}
+
+		return
+	}
+
+	for _, name := range strings.Split(owned, ",") {
+		listeners.owned[name] = true
+	}
+
+	for i, name := range strings.Split(names, ",") {
+		addListener(3+i, name)
+	}
+}
+
+// Add listener for file descriptor 'fd' to set of inherited listeners, keyed
+// by name, or by network and address for listeners without a name. Socket
+// files for owned Unix domain sockets are removed on close.
+func addListener(fd int, name string) {
+	f := os.NewFile(uintptr(fd), name)
+	ln, err := net.FileListener(f)
+	f.Close()
+
+	if err != nil {
+		return
+	}
+
+	if u, ok := ln.(*net.UnixListener); ok {
+		u.SetUnlinkOnClose(listeners.owned[name])
+	}
+
+	if name == "" {
+		name = ln.Addr().Network() + ":" + ln.Addr().String()
+	}
+
+	listeners.inherited[name] = ln
+}
+
+// Remove socket file at 'path' if no process is listening on it.
+func removeStale(path string) {
+	if fi, err := os.Stat(path); err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return
+	}
+
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return
+	}
+
+	os.Remove(path)
+}
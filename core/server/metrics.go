@@ -0,0 +1,128 @@
+// Copyright 2012 - 2014 Alex Palaistras. All rights reserved.
+// Use of this source code is governed by the MIT License, the
+// full text of which can be found in the LICENSE file.
+
+package server
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/deuill/sleepy/core/metrics"
+)
+
+// Metrics for calls to module methods and requests served over HTTP. Error codes
+// are given as '0' for calls that succeeded.
+var (
+	callsTotal = metrics.NewCounter("sleepy_calls_total",
+		"Calls to module methods, by module, method and error code.", "module", "method", "code")
+	callDuration = metrics.NewHistogram("sleepy_call_duration_seconds",
+		"Time taken for calls to module methods to complete.", metrics.DefaultBuckets, "module", "method")
+	callsRejected = metrics.NewCounter("sleepy_calls_rejected_total",
+		"Calls rejected before reaching a module, by error code.", "code")
+	httpRequests = metrics.NewCounter("sleepy_http_requests_total",
+		"Requests served by the embedded HTTP server, by handler and status code.", "handler", "status")
+	httpBytes = metrics.NewCounter("sleepy_http_response_bytes_total",
+		"Bytes sent in response bodies by the embedded HTTP server, by handler.", "handler")
+)
+
+// Measure count and duration of calls to module methods, as an interceptor run
+// around every call.
+func measure(c *Call, next Handler) (interface{}, error) {
+	start := time.Now()
+	result, err := next(c)
+
+	code := 0
+	if err != nil {
+		code = toError(err).Code
+	}
+
+	callsTotal.Inc(c.Module, c.Method, strconv.Itoa(code))
+	callDuration.Observe(time.Since(start).Seconds(), c.Module, c.Method)
+
+	return result, err
+}
+
+// A response writer recording the status code and number of bytes written.
+type measuredWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *measuredWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *measuredWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+
+	return n, err
+}
+
+// Write response body read from 'r', via the wrapped writer's ReadFrom where
+// available, so that files are still sent using sendfile where supported.
+func (w *measuredWriter) ReadFrom(r io.Reader) (int64, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	var n int64
+	var err error
+
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(struct{ io.Writer }{w.ResponseWriter}, r)
+	}
+
+	w.bytes += int(n)
+	return n, err
+}
+
+// Flush buffered data to the client, if supported by the wrapped writer.
+func (w *measuredWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+
+		f.Flush()
+	}
+}
+
+// Unwrap returns the wrapped writer, for use by http.ResponseController.
+func (w *measuredWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Return handler counting requests served by 'h' and bytes sent in responses,
+// labelled with handler name 'name'.
+func measured(name string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mw := &measuredWriter{ResponseWriter: w}
+		h.ServeHTTP(mw, r)
+
+		if mw.status == 0 {
+			mw.status = http.StatusOK
+		}
+
+		httpRequests.Inc(name, strconv.Itoa(mw.status))
+		httpBytes.Add(float64(mw.bytes), name)
+	})
+}
+
+func init() {
+	Intercept(measure)
+}
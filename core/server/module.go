@@ -0,0 +1,102 @@
+// Copyright 2012 - 2014 Alex Palaistras. All rights reserved.
+// Use of this source code is governed by the MIT License, the
+// full text of which can be found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/deuill/sleepy/core/config"
+)
+
+// Module is the interface implemented by all modules registered with the server.
+// Apart from the methods below, all exported methods on a module can be called
+// via RPC.
+type Module interface {
+	// Setup prepares the module for serving calls, using configuration merged
+	// from the main configuration file and the module's own configuration file.
+	Setup(conf *config.Config) error
+
+	// Shutdown releases any resources held by the module, waiting for pending
+	// work to complete. No calls are made to the module after Shutdown.
+	Shutdown() error
+
+	// Health returns an error if the module is currently unable to serve calls.
+	Health() error
+}
+
+// Reloader is implemented by modules able to apply configuration changes while
+// running. Reload is called with the newly merged configuration, and is to
+// leave the module's current configuration in place if returning an error.
+// Modules not implementing Reloader keep their configuration until restarted.
+type Reloader interface {
+	Reload(conf *config.Config) error
+}
+
+// Status represents the health of a module, as returned by Health.
+type Status struct {
+	Healthy bool
+	Error   string `json:",omitempty"`
+}
+
+// A table of modules registered, by name.
+var modules map[string]Module
+
+// Methods used for managing module lifecycle, which cannot be called via RPC.
+var lifecycle = map[string]bool{
+	"Setup":    true,
+	"Shutdown": true,
+	"Health":   true,
+}
+
+// Shutdown shuts down all modules, returning the first error encountered, if
+// any. All modules are shut down regardless of errors returned by any single
+// module.
+func Shutdown() error {
+	var result error
+
+	for name, m := range modules {
+		if err := m.Shutdown(); err != nil && result == nil {
+			result = fmt.Errorf("Error shutting down module '%s': %s", name, err)
+		}
+	}
+
+	return result
+}
+
+// Health checks the health of all modules concurrently, and returns the status
+// for each module.
+func Health() map[string]*Status {
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+
+	status := make(map[string]*Status, len(modules))
+
+	for name, m := range modules {
+		wg.Add(1)
+		go func(name string, m Module) {
+			defer wg.Done()
+
+			s := &Status{Healthy: true}
+			if err := m.Health(); err != nil {
+				s = &Status{Healthy: false, Error: err.Error()}
+			}
+
+			mutex.Lock()
+			status[name] = s
+			mutex.Unlock()
+		}(name, m)
+	}
+
+	wg.Wait()
+	return status
+}
+
+// Health returns the health status of all modules, as returned by the package-
+// level Health function.
+func (s *Server) Health(_ *struct{}, reply *interface{}) error {
+	*reply = Health()
+	return nil
+}
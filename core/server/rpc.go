@@ -9,10 +9,16 @@
 package server
 
 import (
+	"context"
 	"fmt"
+	"log"
 	"os"
 	"reflect"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/deuill/sleepy/core/config"
 	"github.com/deuill/sleepy/core/user"
@@ -21,12 +27,65 @@ import (
 // A table of module methods registered to be called.
 var methods map[string]map[string]interface{}
 
+// Whether parameters passed by name are decoded strictly.
+var strict atomic.Bool
+
+// Default and maximum time allowed for calls to module methods.
+var timeout atomic.Int64
+
 // Request represents the parameters of an RPC call to Sleepy.
 type Request struct {
-	Module  string      // Module is the name of the module that is to be called.
-	Method  string      // Method is the method name to be called.
-	Authkey string      // Authkey is the authkey for the connecting user.
-	Params  interface{} // Parameters are the RPC method call parameters.
+	Module    string      // Module is the name of the module that is to be called.
+	Method    string      // Method is the method name to be called.
+	Authkey   string      // Authkey is the authkey for the connecting user.
+	Signature string      // Signature is the request signature, sent in place of the authkey.
+	Params    interface{} // Parameters are the RPC method call parameters.
+	Ref       string      // Ref names the request for reference by later requests in a batch.
+	Timeout   float64     // Timeout is the time allowed for the call, in seconds.
+
+	// User authenticated by other means, used if no authkey is given.
+	user *user.User
+
+	// Context the call is made in, cancelled when the client disconnects.
+	ctx context.Context
+
+	// Calls made on the connection the request was received on, including
+	// module methods still running past their deadline.
+	calls *sync.WaitGroup
+}
+
+// Return resources held for call made for request, released by 'release', and
+// counted against calls made on the connection until released.
+func (r *Request) hold(release func()) *hold {
+	if r.calls == nil {
+		return &hold{release: release}
+	}
+
+	r.calls.Add(1)
+	return &hold{release: func() {
+		release()
+		r.calls.Done()
+	}}
+}
+
+// Return context for call made for request, with a deadline set according to
+// the timeout requested or the server-wide timeout, whichever is shorter.
+func (r *Request) context() (context.Context, context.CancelFunc) {
+	ctx := r.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	d := time.Duration(timeout.Load())
+	if t := time.Duration(r.Timeout * float64(time.Second)); t > 0 && (d == 0 || t < d) {
+		d = t
+	}
+
+	if d == 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, d)
 }
 
 // Server is a receiver value for RPC calls from the outside world.
@@ -43,11 +102,24 @@ func (s *Server) Call(req *Request, reply *interface{}) error {
 	return nil
 }
 
-func (s *Server) CallMany(req []*Request, reply *interface{}) error {
+// CallMany calls into module methods for a batch of requests. By default,
+// requests are run in order, and the first error encountered aborts the batch
+// and is returned in place of any results. Batches run as a unit are handled
+// as described in the documentation for Batch.
+func (s *Server) CallMany(b *Batch, reply *interface{}) error {
+	if err := b.check(); err != nil {
+		return err
+	}
+
+	if b.Unit {
+		*reply = b.run()
+		return nil
+	}
+
 	var err error
-	results := make([]interface{}, len(req))
+	results := make([]interface{}, len(b.Requests))
 
-	for i, r := range req {
+	for i, r := range b.Requests {
 		if results[i], err = call(r); err != nil {
 			return err
 		}
@@ -58,44 +130,108 @@ func (s *Server) CallMany(req []*Request, reply *interface{}) error {
 }
 
 func Setup(conf *config.Config) error {
-	confdir := conf.S("directories", "config")
-	for module := range methods {
-		filename := confdir + "/modules.d/" + strings.ToLower(module) + ".conf"
-		if _, err := os.Stat(filename); err != nil {
+	strict.Store(conf.B("sleepy", "strict-params"))
+	timeout.Store(int64(callTimeout(conf)))
+	setLimits(conf)
+	setSigning(conf)
+
+	for module, m := range modules {
+		merged, err := moduleConfig(conf, module)
+		if err != nil {
+			return err
+		} else if merged == nil {
 			delete(methods, module)
+			delete(modules, module)
 			continue
 		}
 
-		if _, exists := methods[module]["Setup"]; exists {
-			method := methods[module]["Setup"].(reflect.Value)
+		if err = m.Setup(merged); err != nil {
+			return fmt.Errorf("Error setting up module '%s': %s", module, err)
+		}
+	}
 
-			modconf, err := config.Load(filename)
-			if err != nil {
-				return fmt.Errorf("Error loading configuration for module '%s': %s", module, err)
-			}
+	return nil
+}
 
-			merged, _ := config.Merge(conf, modconf)
+// Reload applies configuration in 'conf' to the server, and to modules
+// implementing Reloader, merged with configuration files for each module.
+// Configuration files for all modules are loaded before any module is reloaded,
+// so that an error in any file leaves all modules untouched. An error returned
+// by a single module leaves that module's configuration in place, but does not
+// prevent other modules from being reloaded.
+func Reload(conf *config.Config) error {
+	confs := make(map[string]*config.Config, len(modules))
+	for module := range modules {
+		merged, err := moduleConfig(conf, module)
+		if err != nil {
+			return err
+		} else if merged == nil {
+			return fmt.Errorf("Configuration file for module '%s' not found", module)
+		}
 
-			result := method.Call([]reflect.Value{reflect.ValueOf(merged)})
-			if err, ok := result[0].Interface().(error); ok {
-				return err
-			}
+		confs[module] = merged
+	}
 
-			delete(methods[module], "Setup")
+	strict.Store(conf.B("sleepy", "strict-params"))
+	timeout.Store(int64(callTimeout(conf)))
+	setLimits(conf)
+	setSigning(conf)
+
+	var result error
+	for module, m := range modules {
+		r, ok := m.(Reloader)
+		if !ok {
+			continue
+		}
+
+		if err := r.Reload(confs[module]); err != nil && result == nil {
+			result = fmt.Errorf("Error reloading module '%s': %s", module, err)
 		}
 	}
 
-	return nil
+	return result
+}
+
+// Return time allowed for calls to module methods, as set in 'conf'.
+func callTimeout(conf *config.Config) time.Duration {
+	t, err := conf.Int("sleepy", "call-timeout")
+	if err != nil {
+		t = 30
+	}
+
+	return time.Duration(t) * time.Second
+}
+
+// Load configuration file for 'module' and merge with main configuration in
+// 'conf'. Returns nil if no configuration file exists for the module.
+func moduleConfig(conf *config.Config, module string) (*config.Config, error) {
+	filename := conf.S("directories", "config") + "/modules.d/" + strings.ToLower(module) + ".conf"
+	if _, err := os.Stat(filename); err != nil {
+		return nil, nil
+	}
+
+	modconf, err := config.Load(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading configuration for module '%s': %s", module, err)
+	}
+
+	merged, _ := config.Merge(conf, modconf)
+	return merged, nil
 }
 
-func Register(rcvr interface{}) error {
+func Register(rcvr Module) error {
 	r := reflect.ValueOf(rcvr)
 
 	rname := reflect.Indirect(r).Type().Name()
 	methods[rname] = make(map[string]interface{}, r.NumMethod())
+	modules[rname] = rcvr
 
 	for i := 0; i < r.NumMethod(); i++ {
 		mname := r.Type().Method(i).Name
+		if lifecycle[mname] {
+			continue
+		}
+
 		methods[rname][mname] = r.Method(i)
 	}
 
@@ -103,172 +239,180 @@ func Register(rcvr interface{}) error {
 }
 
 func call(req *Request) (interface{}, error) {
-	// Load and authenticate user against predefined rules.
-	_, err := user.Auth(req.Authkey)
+	u, method, err := lookup(req)
 	if err != nil {
 		return nil, err
 	}
 
-	// Validate and call module method.
-	if _, exists := methods[req.Module][req.Method]; exists {
-		var params []reflect.Value
-		method := methods[req.Module][req.Method].(reflect.Value)
-
-		// Validate and prepare parameters for inclusion in call.
-		switch p := req.Params.(type) {
-		case []interface{}:
-			if method.Type().NumIn() != len(p) {
-				return nil, fmt.Errorf("Incorrect number of parameters passed to method '%s.%s', expecting %d, given %d.",
-					req.Module, req.Method, method.Type().NumIn(), len(p))
-			}
+	release, err := acquire(u, req)
+	if err != nil {
+		return nil, err
+	}
 
-			params = make([]reflect.Value, len(p))
-			for i, param := range p {
-				params[i] = reflect.ValueOf(param)
-				if method.Type().In(i).Kind() != params[i].Kind() {
-					return nil, fmt.Errorf("Incorrect parameter #%d for method '%s.%s' should be '%s', is '%s'.",
-						i, req.Module, req.Method, method.Type().In(i).Kind().String(), params[i].Kind().String())
-				}
-			}
-		case map[string]interface{}:
-			if method.Type().NumIn() != 1 {
-				return nil, fmt.Errorf("Incorrect number of parameters passed to method '%s.%s', expected single parameter.",
-					req.Module, req.Method)
-			}
+	ctx, cancel := req.context()
+	defer cancel()
 
-			value := reflect.New(method.Type().In(0)).Elem()
-			if err = unpack(p, value); err != nil {
-				return nil, err
-			}
+	return perform(&Call{u, req.Module, req.Method, req.Params, ctx, req.hold(release)}, method)
+}
 
-			params = []reflect.Value{value}
-		default:
-			return nil, fmt.Errorf("Incorrect parameter types for method '%s.%s'.", req.Module, req.Method)
-		}
+// Authenticate user for request and return method to be called, if the user
+// has been granted permission to call it.
+func lookup(req *Request) (*user.User, reflect.Value, error) {
+	u, err := authenticate(req)
+	if err != nil {
+		return nil, reflect.Value{}, reject(req, u, err)
+	}
 
-		result := method.Call(params)
-		if len(result) != 2 {
-			return nil, fmt.Errorf("Incorrect number of return values for method '%s.%s'.", req.Module, req.Method)
-		}
+	if _, exists := methods[req.Module][req.Method]; !exists {
+		err = Errorf(MethodNotFound, "Method '%s.%s' does not exist.", req.Module, req.Method)
+		return nil, reflect.Value{}, reject(req, u, err)
+	}
+
+	return u, methods[req.Module][req.Method].(reflect.Value), nil
+}
 
-		// Check for error message returned.
-		if err, ok := result[1].Interface().(error); ok {
-			return nil, err
+// Authenticate user for request and check that the user has been granted
+// permission to call the method requested. The user is returned alongside the
+// error for users not granted permission.
+func authenticate(req *Request) (*user.User, *Error) {
+	// Load and authenticate user by request signature or authkey, unless
+	// already authenticated by TLS client certificate.
+	var err error
+	u := req.user
+	if req.Signature != "" {
+		if u, err = verify(req.Signature, req.Module+"."+req.Method, req.Params); err != nil {
+			return nil, Errorf(Unauthorized, "%s", err)
+		}
+	} else if u == nil || req.Authkey != "" {
+		if requireSigned.Load() {
+			return nil, Errorf(Unauthorized, "Requests must be signed.")
+		} else if u, err = user.Auth(req.Authkey); err != nil {
+			return nil, Errorf(Unauthorized, "%s", err)
 		}
+	}
 
-		return result[0].Interface(), nil
+	// Check that user has been granted permission to call method.
+	if ok, err := u.Can(req.Module, req.Method); err != nil {
+		return u, Errorf(InternalError, "%s", err)
+	} else if !ok {
+		return u, Errorf(Forbidden, "User is not permitted to call method '%s.%s'.", req.Module, req.Method)
 	}
 
-	return nil, fmt.Errorf("Method '%s.%s' does not exist.", req.Module, req.Method)
+	return u, nil
 }
 
-func unpack(data map[string]interface{}, dest reflect.Value) error {
-	// Check if we're unpacking to a struct.
-	if dest.Kind() != reflect.Struct {
-		return fmt.Errorf("Cannot unpack map[string]interface{} to value of type '%s', aborting.",
-			dest.Kind().String())
+// Validate call parameters against method signature and call method, passing
+// the call's context to methods accepting one.
+func invoke(req *Call, method reflect.Value) (interface{}, error) {
+	var params []reflect.Value
+
+	ctx := req.Context
+	if ctx == nil {
+		ctx = context.Background()
 	}
 
-	// Create map of first-level fields in destination struct.
-	fields := make(map[string]int, dest.NumField())
-	for i := 0; i < dest.NumField(); i++ {
-		f := dest.Type().Field(i)
-		fields[strings.ToLower(f.Name)] = i
+	ctx = context.WithValue(ctx, callerKey{}, req.User)
+
+	// Methods accepting a context as their first parameter are passed the
+	// call's context, in addition to any parameters sent by the client.
+	t, offset := method.Type(), 0
+	if t.NumIn() > 0 && t.In(0) == contextType {
+		params, offset = []reflect.Value{reflect.ValueOf(ctx)}, 1
 	}
 
-	// Copy fields from map to struct recursively.
-	for key, v := range data {
-		key = strings.ToLower(key)
-		field := dest.Field(fields[key])
-		switch value := v.(type) {
-		case map[string]interface{}:
-			if field.Kind() == reflect.Struct {
-				if err := unpack(value, field); err != nil {
-					return err
-				}
-			} else if field.Kind() == reflect.Map && field.Type().Key().Kind() == reflect.String {
-				field.Set(reflect.MakeMap(field.Type()))
-
-				for k, val := range value {
-					assignMap(k, val, field.Type().Elem(), field)
-				}
-			} else {
-				assign(value, field)
-			}
-		case []interface{}:
-			if field.Kind() != reflect.Slice {
-				return fmt.Errorf("Cannot unpack []interface{} to value of type '%s', aborting.",
-					field.Kind().String())
-			}
+	// Validate and prepare parameters for inclusion in call.
+	switch p := req.Params.(type) {
+	case nil:
+		if t.NumIn() != offset {
+			return nil, Errorf(InvalidParams, "Incorrect number of parameters passed to method '%s.%s', expecting %d, given none.",
+				req.Module, req.Method, t.NumIn()-offset)
+		}
+	case []interface{}:
+		if t.NumIn()-offset != len(p) {
+			return nil, Errorf(InvalidParams, "Incorrect number of parameters passed to method '%s.%s', expecting %d, given %d.",
+				req.Module, req.Method, t.NumIn()-offset, len(p))
+		}
+
+		// Positional parameters are always checked strictly against the types
+		// expected by the method.
+		dec := &decoder{strict: true}
 
-			field.Set(reflect.MakeSlice(field.Type(), len(value), cap(value)))
-
-			for i, v := range value {
-				switch value := v.(type) {
-				case map[string]interface{}:
-					t := field.Type().Elem()
-					if t.Kind() == reflect.Struct {
-						if err := unpack(value, field.Index(i)); err != nil {
-							return err
-						}
-					} else if t.Kind() == reflect.Map && t.Key().Kind() == reflect.String {
-						field.Index(i).Set(reflect.MakeMap(field.Index(i).Type()))
-
-						for k, val := range value {
-							assignMap(k, val, t.Elem(), field.Index(i))
-						}
-					} else {
-						assign(value, field.Index(i))
-					}
-				default:
-					assign(value, field.Index(i))
-				}
+		for i, param := range p {
+			value := reflect.New(t.In(offset + i)).Elem()
+			if err := dec.decode("params["+strconv.Itoa(i)+"]", param, value); err != nil {
+				return nil, Errorf(InvalidParams, "Incorrect parameter #%d for method '%s.%s': %s", i, req.Module, req.Method, err)
 			}
-		default:
-			assign(value, field)
-		}
-	}
 
-	return nil
-}
+			params = append(params, value)
+		}
+	case map[string]interface{}:
+		if t.NumIn()-offset != 1 {
+			return nil, Errorf(InvalidParams, "Incorrect number of parameters passed to method '%s.%s', expected single parameter.",
+				req.Module, req.Method)
+		}
 
-func assign(val interface{}, dest reflect.Value) {
-	if val != nil {
-		v := reflect.ValueOf(val)
-		if ok := v.Type().AssignableTo(dest.Type()); ok {
-			dest.Set(v)
-		} else if ok := v.Type().ConvertibleTo(dest.Type()); ok {
-			dest.Set(v.Convert(dest.Type()))
-		} else {
-			dest.Set(reflect.Zero(dest.Type()))
+		path := t.In(offset).Name()
+		if path == "" {
+			path = "params"
 		}
-	}
-}
 
-func assignMap(key, val interface{}, elem reflect.Type, dest reflect.Value) {
-	if val != nil {
-		if v, ok := val.(map[string]interface{}); ok &&
-			elem.Kind() == reflect.Map && elem.Key().Kind() == reflect.String {
+		value := reflect.New(t.In(offset)).Elem()
+		if err := (&decoder{strict: strict.Load()}).decode(path, p, value); err != nil {
+			return nil, Errorf(InvalidParams, "%s", err)
+		}
 
-			dest.SetMapIndex(reflect.ValueOf(key), reflect.MakeMap(elem))
+		params = append(params, value)
+	default:
+		return nil, Errorf(InvalidParams, "Incorrect parameter types for method '%s.%s'.", req.Module, req.Method)
+	}
 
-			for k, value := range v {
-				assignMap(k, value, elem.Elem(), dest.MapIndex(reflect.ValueOf(key)))
-			}
-		} else {
-			v := reflect.ValueOf(val)
-			if ok := v.Type().AssignableTo(elem); ok {
-				dest.SetMapIndex(reflect.ValueOf(key), v)
-			} else if ok := v.Type().ConvertibleTo(elem); ok {
-				dest.SetMapIndex(reflect.ValueOf(key), v.Convert(elem))
-			} else {
-				dest.SetMapIndex(reflect.ValueOf(key), reflect.Zero(elem))
+	// Return as soon as the call's deadline passes, even for methods that do
+	// not accept a context, or do not return when their context is done.
+	out := make(chan []reflect.Value, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("Call to method '%s.%s' panicked: %v", req.Module, req.Method, r)
+				out <- nil
 			}
+		}()
+
+		out <- method.Call(params)
+	}()
+
+	var result []reflect.Value
+	select {
+	case result = <-out:
+	case <-ctx.Done():
+		// Resources held for the call are released once the method returns,
+		// rather than now, so that methods ignoring their context still count
+		// against limits for as long as they run.
+		if release := req.hold.take(); release != nil {
+			go func() {
+				<-out
+				release()
+			}()
 		}
+
+		return nil, Errorf(Timeout, "Call to method '%s.%s' did not complete in time: %s", req.Module, req.Method, ctx.Err())
 	}
+
+	if result == nil {
+		return nil, Errorf(InternalError, "Call to method '%s.%s' failed unexpectedly.", req.Module, req.Method)
+	} else if len(result) != 2 {
+		return nil, Errorf(InternalError, "Incorrect number of return values for method '%s.%s'.", req.Module, req.Method)
+	}
+
+	// Check for error message returned.
+	if err, ok := result[1].Interface().(error); ok {
+		return nil, err
+	}
+
+	return result[0].Interface(), nil
 }
 
 func init() {
-	// Initialize the method table.
+	// Initialize the method and module tables.
 	methods = make(map[string]map[string]interface{})
+	modules = make(map[string]Module)
 }
@@ -0,0 +1,152 @@
+// Copyright 2012 - 2014 Alex Palaistras. All rights reserved.
+// Use of this source code is governed by the MIT License, the
+// full text of which can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/deuill/sleepy/core/config"
+	"github.com/deuill/sleepy/core/user"
+)
+
+// Time before or after a request is signed during which the signature is
+// accepted, and whether requests must be signed instead of carrying authkeys.
+var (
+	signatureWindow atomic.Int64
+	requireSigned   atomic.Bool
+)
+
+// A request signature, as sent by the client in the form
+// '<key prefix>:<timestamp>:<nonce>:<signature>', where the key prefix is the
+// first characters of the authkey signed with, the timestamp is given in
+// seconds since the Unix epoch, and the signature is the hex-encoded
+// HMAC-SHA256 of the canonical request.
+type signature struct {
+	key       string
+	timestamp int64
+	nonce     string
+	mac       []byte
+}
+
+// Set options for request signing from the '[sleepy]' section in 'conf'.
+func setSigning(conf *config.Config) {
+	window, err := conf.Int("sleepy", "signature-window")
+	if err != nil || window <= 0 {
+		window = 300
+	}
+
+	signatureWindow.Store(int64(time.Duration(window) * time.Second))
+	requireSigned.Store(conf.B("sleepy", "require-signatures"))
+}
+
+// Parse signature in 's', as sent by the client.
+func parseSignature(s string) (*signature, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("Signature is malformed.")
+	}
+
+	if parts[0] == "" {
+		return nil, fmt.Errorf("Signature is malformed, key prefix is empty.")
+	}
+
+	timestamp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Signature is malformed, timestamp '%s' is not a number.", parts[1])
+	}
+
+	if len(parts[2]) == 0 || len(parts[2]) > 64 {
+		return nil, fmt.Errorf("Signature is malformed, nonce must be between 1 and 64 characters long.")
+	}
+
+	mac, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return nil, fmt.Errorf("Signature is malformed, signature is not hex-encoded.")
+	}
+
+	return &signature{parts[0], timestamp, parts[2], mac}, nil
+}
+
+// Return the canonical form of a request for 'method' with parameters in
+// 'params', signed with the timestamp and nonce in 'sig'. This is made up of the
+// timestamp, the nonce, the fully-qualified method name and the hex-encoded
+// SHA-256 hash of the parameters, encoded as JSON with object keys sorted and
+// without HTML escaping or insignificant whitespace, each on its own line.
+func canonical(sig *signature, method string, params interface{}) (string, error) {
+	var buf bytes.Buffer
+
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(params); err != nil {
+		return "", fmt.Errorf("Parameters cannot be encoded: %s", err)
+	}
+
+	digest := sha256.Sum256(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+	return strconv.FormatInt(sig.timestamp, 10) + "\n" + sig.nonce + "\n" + method + "\n" + hex.EncodeToString(digest[:]), nil
+}
+
+// Verify signature in 's' for a request for 'method' with parameters in
+// 'params', returning the user the request was signed by. Signatures are only
+// accepted within the signature window and only once, so that a signature seen
+// by others cannot be used for any other request, or for the same request
+// twice.
+func verify(s, method string, params interface{}) (*user.User, error) {
+	sig, err := parseSignature(s)
+	if err != nil {
+		return nil, err
+	}
+
+	now, window := time.Now(), time.Duration(signatureWindow.Load())
+	if d := now.Sub(time.Unix(sig.timestamp, 0)); d > window || d < -window {
+		return nil, fmt.Errorf("Signature has expired, or the client's clock is off by more than %s.", window)
+	}
+
+	key, err := user.FindKey(sig.key)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := canonical(sig, method, params)
+	if err != nil {
+		return nil, err
+	}
+
+	signing, err := key.SigningKey()
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, signing)
+	mac.Write([]byte(msg))
+	if !hmac.Equal(mac.Sum(nil), sig.mac) {
+		return nil, fmt.Errorf("Signature does not match.")
+	}
+
+	u, err := key.User()
+	if err != nil {
+		return nil, err
+	}
+
+	// Nonces are only recorded for valid signatures, and are remembered for as
+	// long as signatures carrying them may be accepted.
+	if ok, err := key.UseNonce(sig.nonce, time.Unix(sig.timestamp, 0).Add(window)); err != nil {
+		return nil, fmt.Errorf("Error recording signature: %s", err)
+	} else if !ok {
+		return nil, fmt.Errorf("Signature has already been used.")
+	}
+
+	key.Touch()
+
+	return u, nil
+}
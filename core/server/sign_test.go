@@ -0,0 +1,162 @@
+// Copyright 2012 - 2014 Alex Palaistras. All rights reserved.
+// Use of this source code is governed by the MIT License, the
+// full text of which can be found in the LICENSE file.
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deuill/sleepy/core/config"
+	"github.com/deuill/sleepy/core/user"
+)
+
+// Return signature for request for 'method' with parameters in 'params', signed
+// with 'authkey' as a client would.
+func sign(authkey string, timestamp int64, nonce, method string, params interface{}) string {
+	sig := &signature{timestamp: timestamp, nonce: nonce}
+	msg, err := canonical(sig, method, params)
+	if err != nil {
+		panic(err)
+	}
+
+	signing := sha256.Sum256([]byte(authkey))
+	mac := hmac.New(sha256.New, signing[:])
+	mac.Write([]byte(msg))
+
+	return fmt.Sprintf("%s:%d:%s:%x", authkey[:8], timestamp, nonce, mac.Sum(nil))
+}
+
+func TestParseSignature(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want *signature
+		err  string
+	}{
+		{"valid", "e7b6c76d:1388631845:abc:00ff", &signature{"e7b6c76d", 1388631845, "abc", []byte{0x00, 0xff}}, ""},
+		{"too few parts", "e7b6c76d:1388631845:00ff", nil, "Signature is malformed."},
+		{"too many parts", "e7b6c76d:1388631845:abc:def:00ff", nil, "Signature is malformed."},
+		{"empty key prefix", ":1388631845:abc:00ff", nil, "key prefix is empty"},
+		{"timestamp not a number", "e7b6c76d:yesterday:abc:00ff", nil, "timestamp 'yesterday' is not a number"},
+		{"empty nonce", "e7b6c76d:1388631845::00ff", nil, "nonce must be between 1 and 64 characters long"},
+		{"nonce too long", "e7b6c76d:1388631845:" + strings.Repeat("a", 65) + ":00ff", nil, "nonce must be between 1 and 64 characters long"},
+		{"signature not hex", "e7b6c76d:1388631845:abc:xyz", nil, "signature is not hex-encoded"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sig, err := parseSignature(tt.src)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("parseSignature(%s) returned error %v, want error containing '%s'", tt.src, err, tt.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("parseSignature(%s) returned error: %s", tt.src, err)
+			}
+
+			if sig.key != tt.want.key || sig.timestamp != tt.want.timestamp || sig.nonce != tt.want.nonce || !hmac.Equal(sig.mac, tt.want.mac) {
+				t.Errorf("parseSignature(%s) = %+v, want %+v", tt.src, sig, tt.want)
+			}
+		})
+	}
+}
+
+func TestCanonical(t *testing.T) {
+	tests := []struct {
+		name   string
+		params interface{}
+		json   string
+	}{
+		{"no parameters", nil, `null`},
+		{"keys sorted", map[string]interface{}{"b": 1, "a": []interface{}{"x", true}}, `{"a":["x",true],"b":1}`},
+		{"no html escaping", map[string]interface{}{"q": "<a & b>"}, `{"q":"<a & b>"}`},
+		{"unicode kept", "Καλημέρα", `"Καλημέρα"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := canonical(&signature{timestamp: 1388631845, nonce: "abc"}, "Database.Get", tt.params)
+			if err != nil {
+				t.Fatalf("canonical returned error: %s", err)
+			}
+
+			digest := sha256.Sum256([]byte(tt.json))
+			if want := "1388631845\nabc\nDatabase.Get\n" + hex.EncodeToString(digest[:]); got != want {
+				t.Errorf("canonical = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	if err := user.Setup(t.TempDir(), "sleepy.db", &config.Config{}); err != nil {
+		t.Fatalf("setting up user store failed: %s", err)
+	}
+
+	if _, _, err := user.Migrate(); err != nil {
+		t.Fatalf("migrating user store failed: %s", err)
+	}
+
+	u, err := user.Save()
+	if err != nil {
+		t.Fatalf("adding user failed: %s", err)
+	}
+
+	setSigning(&config.Config{})
+
+	now := time.Now().Unix()
+	params := map[string]interface{}{"name": "a"}
+
+	tests := []struct {
+		name   string
+		sig    string
+		method string
+		params interface{}
+		err    string
+	}{
+		{"valid", sign(u.Authkey, now, "n1", "Database.Get", params), "Database.Get", params, ""},
+		{"within window", sign(u.Authkey, now-290, "n2", "Database.Get", params), "Database.Get", params, ""},
+		{"no parameters", sign(u.Authkey, now, "n3", "Database.Get", nil), "Database.Get", nil, ""},
+		{"expired", sign(u.Authkey, now-310, "n4", "Database.Get", params), "Database.Get", params, "Signature has expired"},
+		{"from the future", sign(u.Authkey, now+310, "n5", "Database.Get", params), "Database.Get", params, "Signature has expired"},
+		{"other method", sign(u.Authkey, now, "n6", "Database.Get", params), "Database.Set", params, "Signature does not match."},
+		{"other parameters", sign(u.Authkey, now, "n7", "Database.Get", params), "Database.Get", map[string]interface{}{"name": "b"}, "Signature does not match."},
+		{"other key", sign(u.Authkey[:8]+strings.Repeat("0", len(u.Authkey)-8), now, "n8", "Database.Get", params), "Database.Get", params, "Signature does not match."},
+		{"unknown key", sign("00000000"+u.Authkey[8:], now, "n9", "Database.Get", params), "Database.Get", params, "does not exist."},
+		{"replayed", sign(u.Authkey, now, "n1", "Database.Get", params), "Database.Get", params, "Signature has already been used."},
+		{"replayed, other request", sign(u.Authkey, now, "n3", "Database.Set", params), "Database.Set", params, "Signature has already been used."},
+		{"nonce of failed request", sign(u.Authkey, now, "n6", "Database.Get", params), "Database.Get", params, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := verify(tt.sig, tt.method, tt.params)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("verify returned error %v, want error containing '%s'", err, tt.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("verify returned error: %s", err)
+			}
+
+			if got.Id != u.Id {
+				t.Errorf("verify returned user %d, want %d", got.Id, u.Id)
+			}
+		})
+	}
+}
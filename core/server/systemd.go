@@ -0,0 +1,59 @@
+// Copyright 2012 - 2014 Alex Palaistras. All rights reserved.
+// Use of this source code is governed by the MIT License, the
+// full text of which can be found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Return file descriptors for sockets passed by systemd, mapped to their names
+// as set in 'FileDescriptorName', or empty for sockets without a name.
+func systemdListeners() map[int]string {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	// Sockets are only meant for us if the PID given matches our own.
+	if pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID")); pid != os.Getpid() {
+		return nil
+	}
+
+	n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	fds := make(map[int]string, n)
+	for i := 0; i < n; i++ {
+		var name string
+		if i < len(names) && names[i] != "unknown" {
+			name = names[i]
+		}
+
+		fds[3+i] = name
+	}
+
+	return fds
+}
+
+// Send state notification to systemd, if running under systemd with a service
+// type of 'notify'.
+func notify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
@@ -0,0 +1,62 @@
+// Copyright 2012 - 2014 Alex Palaistras. All rights reserved.
+// Use of this source code is governed by the MIT License, the
+// full text of which can be found in the LICENSE file.
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/deuill/sleepy/core/config"
+)
+
+// TLSConfig returns configuration for serving RPC calls over TLS, as set in the
+// 'sleepy' section of 'conf', or nil if TLS has not been enabled. Clients may
+// be asked for certificates signed by the authorities in 'tls-client-ca',
+// depending on the value of 'tls-client-auth', which is one of:
+//
+//	none     Client certificates are not requested.
+//	request  Client certificates are requested and verified, but not required.
+//	require  Clients are required to present a valid certificate.
+func TLSConfig(conf *config.Config) (*tls.Config, error) {
+	certfile, keyfile := conf.S("sleepy", "tls-cert"), conf.S("sleepy", "tls-key")
+	if certfile == "" && keyfile == "" {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certfile, keyfile)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading TLS certificate: %s", err)
+	}
+
+	t := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	switch auth := conf.S("sleepy", "tls-client-auth"); auth {
+	case "", "none":
+		return t, nil
+	case "request":
+		t.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		t.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("Unknown value '%s' for option 'tls-client-auth'", auth)
+	}
+
+	buf, err := ioutil.ReadFile(conf.S("sleepy", "tls-client-ca"))
+	if err != nil {
+		return nil, fmt.Errorf("Error loading client certificate authorities: %s", err)
+	}
+
+	t.ClientCAs = x509.NewCertPool()
+	if !t.ClientCAs.AppendCertsFromPEM(buf) {
+		return nil, fmt.Errorf("No valid certificates found in file '%s'", conf.S("sleepy", "tls-client-ca"))
+	}
+
+	return t, nil
+}
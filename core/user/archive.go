@@ -0,0 +1,603 @@
+// Copyright 2012 - 2014 Alex Palaistras. All rights reserved.
+// Use of this source code is governed by the MIT License, the
+// full text of which can be found in the LICENSE file.
+
+package user
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version of archives made by Export. Archives of later versions are refused
+// by Import. Keys in archives of version 1 carry signing keys in place of their
+// hashes.
+const ArchiveVersion = 2
+
+// Ways of handling users imported with ids already in use, either failing the
+// import, skipping the user, replacing the existing user, or importing the user
+// under a new id.
+const (
+	ConflictFail     = "fail"
+	ConflictSkip     = "skip"
+	ConflictReplace  = "replace"
+	ConflictRenumber = "renumber"
+)
+
+// Directories under the data directory holding files for each user, in a
+// directory named after the user's id. These are files served for the File and
+// Image modules, and files cached by the Template module.
+var archiveDirs = []string{"serve", "cache"}
+
+// Archive holds users along with their keys, permissions, certificate subjects,
+// configuration and, optionally, files, for moving users between instances of
+// Sleepy, or for backups.
+type Archive struct {
+	Version  int            `json:"version"`
+	Exported time.Time      `json:"exported"`
+	Users    []ArchivedUser `json:"users"`
+}
+
+// ArchivedUser is a single user in an archive. Files are keyed by the directory
+// they are kept in, followed by their path relative to the user's directory,
+// e.g. 'serve/ab/cdef/...', and are nil if not exported.
+type ArchivedUser struct {
+	Id           int                                     `json:"id"`
+	Name         string                                  `json:"name"`
+	Email        string                                  `json:"email"`
+	Labels       []string                                `json:"labels"`
+	Status       string                                  `json:"status"`
+	Created      time.Time                               `json:"created"`
+	LastSeen     time.Time                               `json:"last_seen"`
+	Keys         []ArchivedKey                           `json:"keys"`
+	Permissions  []string                                `json:"permissions"`
+	Certificates []string                                `json:"certificates"`
+	Config       map[string]map[string]map[string]string `json:"config"`
+	Files        map[string][]byte                       `json:"files"`
+}
+
+// ArchivedKey is a key issued to an archived user. Keys are archived as stored,
+// with the signing key encrypted with the secret key of the instance exporting
+// it, so that authkeys remain valid after import, but cannot be recovered from
+// archives.
+type ArchivedKey struct {
+	Name     string    `json:"name"`
+	Prefix   string    `json:"prefix"`
+	Hash     string    `json:"hash"`
+	Secret   string    `json:"secret"`
+	Created  time.Time `json:"created"`
+	Expires  time.Time `json:"expires"`
+	LastUsed time.Time `json:"last_used"`
+}
+
+// Export returns archive of users with ids in 'ids', or all users if none are
+// given. Files kept for each user under 'datadir' are included if 'files' is
+// true. Files cached by the Template module under authkeys rather than user ids
+// are not included, as these would reveal the authkeys themselves.
+func Export(datadir string, files bool, ids ...int) (*Archive, error) {
+	var users []User
+	if len(ids) == 0 {
+		var error error
+		if users, error = List(); error != nil {
+			return nil, error
+		}
+	} else {
+		for _, id := range ids {
+			user, error := Get(id)
+			if error != nil {
+				return nil, error
+			}
+
+			users = append(users, *user)
+		}
+	}
+
+	archive := &Archive{Version: ArchiveVersion, Exported: time.Unix(time.Now().Unix(), 0).UTC()}
+
+	for _, u := range users {
+		a, error := u.archive()
+		if error != nil {
+			return nil, fmt.Errorf("Unable to export user with id '%d': %s", u.Id, error)
+		}
+
+		if files {
+			if a.Files, error = readFiles(datadir, u.Id); error != nil {
+				return nil, fmt.Errorf("Unable to export files for user with id '%d': %s", u.Id, error)
+			}
+		}
+
+		archive.Users = append(archive.Users, *a)
+	}
+
+	return archive, nil
+}
+
+// Import adds users in 'archive', with users whose ids are already in use
+// handled as set in 'conflict'. Files included in the archive are written under
+// 'datadir', replacing any files kept for the user. All users are checked for
+// conflicts before any user is added, and each user is added in a single
+// transaction, so that users failing to import are left as they were. Returned
+// are the ids users were imported under, keyed by their ids in the archive,
+// leaving out users skipped.
+func Import(archive *Archive, datadir, conflict string) (map[int]int, error) {
+	if archive.Version == 0 {
+		return nil, fmt.Errorf("Archive has no version, and may not have been made by Sleepy.")
+	} else if archive.Version > ArchiveVersion {
+		return nil, fmt.Errorf("Archive version %d is newer than the latest version supported, %d; please upgrade Sleepy.", archive.Version, ArchiveVersion)
+	}
+
+	switch conflict {
+	case ConflictFail, ConflictSkip, ConflictReplace, ConflictRenumber:
+	default:
+		return nil, fmt.Errorf("Conflict handling '%s' is not valid, expecting '%s', '%s', '%s' or '%s'.", conflict,
+			ConflictFail, ConflictSkip, ConflictReplace, ConflictRenumber)
+	}
+
+	// Check all users before importing any, so that conflicts do not result in
+	// partial imports.
+	plan := make([]importPlan, 0, len(archive.Users))
+	seen := make(map[string]int)
+
+	for i := range archive.Users {
+		a := &archive.Users[i]
+
+		p, error := check(a, archive.Version, conflict)
+		if error != nil {
+			return nil, fmt.Errorf("Unable to import user with id '%d': %s", a.Id, error)
+		} else if p.skip {
+			continue
+		}
+
+		// Ids, key prefixes and certificate subjects may only appear once.
+		names := []string{"id " + strconv.Itoa(a.Id)}
+		for _, k := range a.Keys {
+			names = append(names, "key prefix "+k.Prefix)
+		}
+
+		for _, s := range a.Certificates {
+			names = append(names, "certificate subject "+s)
+		}
+
+		for _, name := range names {
+			if id, exists := seen[name]; exists {
+				return nil, fmt.Errorf("Unable to import user with id '%d': %s already used by user with id '%d' in archive.", a.Id, name, id)
+			}
+
+			seen[name] = a.Id
+		}
+
+		plan = append(plan, p)
+	}
+
+	// Users keeping their ids are imported first, so that ids given to users
+	// imported under new ids do not conflict with them.
+	sort.SliceStable(plan, func(i, j int) bool {
+		return !plan[i].renumber && plan[j].renumber
+	})
+
+	imported := make(map[int]int, len(plan))
+	for i, p := range plan {
+		if p.renumber && (i == 0 || !plan[i-1].renumber) {
+			if error := syncIds(); error != nil {
+				return imported, fmt.Errorf("Unable to import user with id '%d': %s", p.user.Id, error)
+			}
+		}
+
+		id, error := p.apply(datadir)
+		if error != nil {
+			return imported, fmt.Errorf("Unable to import user with id '%d': %s", p.user.Id, error)
+		}
+
+		imported[p.user.Id] = id
+	}
+
+	if error := syncIds(); error != nil {
+		return imported, fmt.Errorf("Unable to update sequence for user ids: %s", error)
+	}
+
+	return imported, nil
+}
+
+// Advance the sequence ids for new users are taken from past ids of users
+// imported. Only PostgreSQL keeps sequences apart from tables, and does not
+// advance them for ids inserted explicitly.
+func syncIds() error {
+	if s, ok := db.(*sqlStore); ok && s.dialect == "postgres" {
+		_, error := s.Exec(`SELECT setval(pg_get_serial_sequence('users', 'id'), (SELECT MAX(id) FROM users))`)
+		return error
+	}
+
+	return nil
+}
+
+// Return archive of user, without files.
+func (u *User) archive() (*ArchivedUser, error) {
+	a := &ArchivedUser{
+		Id:       u.Id,
+		Name:     u.Name,
+		Email:    u.Email,
+		Labels:   u.Labels,
+		Status:   u.Status,
+		Created:  u.Created,
+		LastSeen: u.LastSeen,
+		Config:   make(map[string]map[string]map[string]string),
+	}
+
+	keys, error := u.Keys()
+	if error != nil {
+		return nil, error
+	}
+
+	for _, k := range keys {
+		a.Keys = append(a.Keys, ArchivedKey{k.Name, k.Prefix, hex.EncodeToString(k.hash), hex.EncodeToString(k.secret), k.Created, k.Expires, k.LastUsed})
+	}
+
+	if a.Permissions, error = u.Permissions(); error != nil {
+		return nil, error
+	}
+
+	if a.Certificates, error = u.Certificates(); error != nil {
+		return nil, error
+	}
+
+	modules, error := u.Modules()
+	if error != nil {
+		return nil, error
+	}
+
+	for _, module := range modules {
+		conf, error := u.Conf(module)
+		if error != nil {
+			return nil, error
+		}
+
+		a.Config[module] = make(map[string]map[string]string)
+		for section, options := range *conf {
+			a.Config[module][section] = make(map[string]string)
+			for option := range options {
+				a.Config[module][section][option] = conf.S(section, option)
+			}
+		}
+	}
+
+	return a, nil
+}
+
+// A user to be imported, as checked against existing users.
+type importPlan struct {
+	user     *ArchivedUser
+	keys     []*Key
+	skip     bool // Whether the user is skipped, as their id is in use.
+	replace  bool // Whether the existing user with the same id is removed first.
+	renumber bool // Whether the user is imported under a new id.
+}
+
+// Check that user in 'a', from archive of version 'version', can be imported,
+// with conflicting ids handled as set in 'conflict', and return plan for
+// importing the user.
+func check(a *ArchivedUser, version int, conflict string) (importPlan, error) {
+	p := importPlan{user: a}
+
+	if _, error := Get(a.Id); error == nil {
+		switch conflict {
+		case ConflictFail:
+			return p, fmt.Errorf("User with id '%d' already exists.", a.Id)
+		case ConflictSkip:
+			p.skip = true
+			return p, nil
+		case ConflictReplace:
+			p.replace = true
+		case ConflictRenumber:
+			p.renumber = true
+		}
+	}
+
+	if a.Status != "" && a.Status != Enabled && a.Status != Suspended {
+		return p, fmt.Errorf("Status '%s' is not valid, expecting '%s' or '%s'.", a.Status, Enabled, Suspended)
+	}
+
+	if a.Email != "" {
+		if _, error := mail.ParseAddress(a.Email); error != nil {
+			return p, fmt.Errorf("Email address '%s' is not valid.", a.Email)
+		}
+	}
+
+	if _, error := cleanLabels(a.Labels); error != nil {
+		return p, error
+	}
+
+	for _, perm := range a.Permissions {
+		if error := checkPermission(perm); error != nil {
+			return p, error
+		}
+	}
+
+	// Keys and certificate subjects may only be in use by the user replaced.
+	owner := func(query string, args ...interface{}) error {
+		var id int
+		if error := db.QueryRow(query, args...).Scan(&id); error == sql.ErrNoRows {
+			return nil
+		} else if error != nil {
+			return fmt.Errorf("unable to check: %s", error)
+		} else if p.replace && id == a.Id {
+			return nil
+		}
+
+		return fmt.Errorf("already in use by user with id '%d'", id)
+	}
+
+	names := make(map[string]bool, len(a.Keys))
+	for _, k := range a.Keys {
+		key, error := archivedKey(k, version)
+		if error != nil {
+			return p, error
+		} else if k.Name == "" || len(k.Prefix) != prefixLen {
+			return p, fmt.Errorf("Key '%s' has an invalid name or prefix.", k.Name)
+		} else if names[k.Name] {
+			return p, fmt.Errorf("Key named '%s' appears more than once.", k.Name)
+		}
+
+		if error = owner(`SELECT user_id FROM user_keys WHERE prefix = ?`, k.Prefix); error != nil {
+			return p, fmt.Errorf("Key with prefix '%s' is %s.", k.Prefix, error)
+		}
+
+		names[k.Name] = true
+		p.keys = append(p.keys, key)
+	}
+
+	for _, s := range a.Certificates {
+		if error := owner(`SELECT user_id FROM user_certs WHERE subject = ?`, s); error != nil {
+			return p, fmt.Errorf("Certificate subject '%s' is %s.", s, error)
+		}
+	}
+
+	for name := range a.Files {
+		dir, path, _ := strings.Cut(name, "/")
+		if !archived(dir) || !filepath.IsLocal(path) {
+			return p, fmt.Errorf("File '%s' is not valid.", name)
+		}
+	}
+
+	return p, nil
+}
+
+// Return key archived in 'k', from archive of version 'version'. Signing keys
+// are to be encrypted with the secret key of this instance, and signing keys
+// archived in place of hashes, as in archives of version 1, are encrypted.
+func archivedKey(k ArchivedKey, version int) (*Key, error) {
+	key := &Key{Name: k.Name, Prefix: k.Prefix, Created: k.Created, Expires: k.Expires, LastUsed: k.LastUsed}
+
+	hash, error := hex.DecodeString(k.Hash)
+	if error != nil || len(hash) != 32 {
+		return nil, fmt.Errorf("Key '%s' has an invalid hash.", k.Name)
+	}
+
+	if version == 1 {
+		if key.secret, error = seal(hash); error != nil {
+			return nil, error
+		}
+
+		key.hash = digest(hash)
+		return key, nil
+	}
+
+	if key.secret, error = hex.DecodeString(k.Secret); error != nil {
+		return nil, fmt.Errorf("Key '%s' has an invalid signing key.", k.Name)
+	} else if _, error = unseal(key.secret); error != nil {
+		return nil, fmt.Errorf("Signing key for key '%s' was not encrypted with the secret key of this instance.", k.Name)
+	}
+
+	key.hash = hash
+	return key, nil
+}
+
+// Import user as planned, writing files under 'datadir', and return the id the
+// user was imported under. Users are imported in a single transaction, and files
+// are written before the transaction is committed and put in place after.
+func (p importPlan) apply(datadir string) (int, error) {
+	var staged string
+	if p.user.Files != nil {
+		var error error
+		if staged, error = stageFiles(datadir, p.user.Files); error != nil {
+			return 0, error
+		}
+
+		defer os.RemoveAll(staged)
+	}
+
+	tx, error := db.Begin()
+	if error != nil {
+		return 0, error
+	}
+
+	id, error := p.insert(tx)
+	if error != nil {
+		tx.Rollback()
+		return 0, error
+	} else if error = tx.Commit(); error != nil {
+		return 0, error
+	}
+
+	if staged != "" {
+		if error = installFiles(datadir, id, staged); error != nil {
+			return id, fmt.Errorf("User imported, but files were not: %s", error)
+		}
+	}
+
+	return id, nil
+}
+
+// Add user as planned, running queries with 'q', and return the id the user was
+// added under.
+func (p importPlan) insert(q Querier) (int, error) {
+	a := p.user
+	if p.replace {
+		if _, error := remove(q, a.Id); error != nil {
+			return 0, error
+		}
+	}
+
+	var created, seen int64
+	if !a.Created.IsZero() {
+		created = a.Created.Unix()
+	}
+
+	if !a.LastSeen.IsZero() {
+		seen = a.LastSeen.Unix()
+	}
+
+	id := int64(a.Id)
+	if p.renumber {
+		query := `INSERT INTO users (authkey, created, last_seen) VALUES ('', ?, ?)`
+		var error error
+		if id, error = q.Insert(query, created, seen); error != nil {
+			return 0, error
+		}
+	} else {
+		query := `INSERT INTO users (id, authkey, created, last_seen) VALUES (?, '', ?, ?)`
+		if _, error := q.Exec(query, id, created, seen); error != nil {
+			return 0, error
+		}
+	}
+
+	u := &User{Id: int(id), Name: a.Name, Email: a.Email, Labels: a.Labels, Status: a.Status}
+	if error := u.update(q); error != nil {
+		return u.Id, error
+	}
+
+	for _, key := range p.keys {
+		key.userId = u.Id
+		if error := insertKey(q, key); error != nil {
+			return u.Id, error
+		}
+	}
+
+	for _, perm := range a.Permissions {
+		if error := u.grant(q, perm); error != nil {
+			return u.Id, error
+		}
+	}
+
+	for _, subject := range a.Certificates {
+		if error := u.addCertificate(q, subject); error != nil {
+			return u.Id, error
+		}
+	}
+
+	for module, sections := range a.Config {
+		for section, options := range sections {
+			for option, value := range options {
+				if _, error := u.setOption(q, module, section, option, value); error != nil {
+					return u.Id, error
+				}
+			}
+		}
+	}
+
+	return u.Id, nil
+}
+
+// Return files kept for user with id 'id' under 'datadir', keyed as described
+// for ArchivedUser.
+func readFiles(datadir string, id int) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+
+	for _, dir := range archiveDirs {
+		root := filepath.Join(datadir, dir, strconv.Itoa(id))
+
+		error := filepath.WalkDir(root, func(path string, d fs.DirEntry, error error) error {
+			if error != nil {
+				if path == root && os.IsNotExist(error) {
+					return filepath.SkipDir
+				}
+
+				return error
+			} else if !d.Type().IsRegular() {
+				return nil
+			}
+
+			rel, error := filepath.Rel(root, path)
+			if error != nil {
+				return error
+			}
+
+			files[dir+"/"+filepath.ToSlash(rel)], error = os.ReadFile(path)
+			return error
+		})
+
+		if error != nil {
+			return nil, error
+		}
+	}
+
+	return files, nil
+}
+
+// Write files in 'files', keyed as described for ArchivedUser, to a temporary
+// directory under 'datadir', returning the path to the directory, to be put in
+// place by installFiles.
+func stageFiles(datadir string, files map[string][]byte) (string, error) {
+	staged, error := os.MkdirTemp(datadir, ".import-")
+	if error != nil {
+		return "", error
+	}
+
+	for name, data := range files {
+		path := filepath.Join(staged, filepath.FromSlash(name))
+		if error = os.MkdirAll(filepath.Dir(path), 0755); error != nil {
+			break
+		} else if error = os.WriteFile(path, data, 0644); error != nil {
+			break
+		}
+	}
+
+	if error != nil {
+		os.RemoveAll(staged)
+		return "", error
+	}
+
+	return staged, nil
+}
+
+// Put files written to 'staged' by stageFiles in place for user with id 'id'
+// under 'datadir', replacing any files already kept for the user.
+func installFiles(datadir string, id int, staged string) error {
+	for _, dir := range archiveDirs {
+		path := filepath.Join(datadir, dir, strconv.Itoa(id))
+		if error := os.RemoveAll(path); error != nil {
+			return error
+		}
+
+		if _, error := os.Stat(filepath.Join(staged, dir)); os.IsNotExist(error) {
+			continue
+		}
+
+		if error := os.MkdirAll(filepath.Dir(path), 0755); error != nil {
+			return error
+		} else if error = os.Rename(filepath.Join(staged, dir), path); error != nil {
+			return error
+		}
+	}
+
+	return nil
+}
+
+// Check that files in directory 'dir' are archived.
+func archived(dir string) bool {
+	for _, d := range archiveDirs {
+		if d == dir {
+			return true
+		}
+	}
+
+	return false
+}
@@ -8,14 +8,21 @@ import (
 	"fmt"
 )
 
+// Auth returns user issued the key for 'authkey', if the key has not expired and
+// the user is not suspended.
 func Auth(authkey string) (*User, error) {
-	user := new(User)
+	key, error := FindKey(prefix(authkey))
+	if error != nil || !key.matches(authkey) {
+		return nil, fmt.Errorf("Authkey did not match any user.")
+	}
 
-	query := `SELECT id, authkey FROM users WHERE authkey = ?`
-	error := db.QueryRow(query, authkey).Scan(&user.Id, &user.Authkey)
+	user, error := key.User()
 	if error != nil {
-		return nil, fmt.Errorf("User with authkey '%s' did not authenticate: %s", authkey, error)
+		return nil, error
 	}
 
+	key.Touch()
+	user.Authkey = authkey
+
 	return user, nil
 }
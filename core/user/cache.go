@@ -0,0 +1,130 @@
+// Copyright 2012 - 2014 Alex Palaistras. All rights reserved.
+// Use of this source code is governed by the MIT License, the
+// full text of which can be found in the LICENSE file.
+
+package user
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/deuill/sleepy/core/config"
+)
+
+// Keys looked up recently, along with the users they were issued to, keyed by
+// key prefix. Keys are evicted once their time-to-live has passed, or when the
+// cache is full, in order of least recent use. Removing a user or revoking a
+// key evicts affected keys immediately, though only from the cache of the
+// process making the change; other processes empty their cache on Reload.
+var cache struct {
+	sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+// A key held in the cache, along with the user it was issued to.
+type cacheEntry struct {
+	key     Key
+	user    User
+	expires time.Time
+}
+
+// Set size and time-to-live for the cache from the '[users]' section in 'conf',
+// and empty the cache.
+func setCache(conf *config.Config) {
+	size, error := conf.Int("users", "cache-size")
+	if error != nil || size < 0 {
+		size = 1024
+	}
+
+	ttl, error := conf.Int("users", "cache-ttl")
+	if error != nil || ttl < 0 {
+		ttl = 60
+	}
+
+	cache.Lock()
+	defer cache.Unlock()
+
+	cache.size, cache.ttl = int(size), time.Duration(ttl)*time.Second
+	cache.entries, cache.order = make(map[string]*list.Element), list.New()
+}
+
+// Return key with prefix 'prefix' and the user it was issued to from the cache,
+// if present and not yet expired.
+func cached(prefix string) (*Key, *User, bool) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	e, exists := cache.entries[prefix]
+	if !exists {
+		return nil, nil, false
+	}
+
+	entry := e.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		cache.order.Remove(e)
+		delete(cache.entries, prefix)
+		return nil, nil, false
+	}
+
+	cache.order.MoveToFront(e)
+	key, user := entry.key, entry.user
+
+	return &key, &user, true
+}
+
+// Add 'key' and 'user' to the cache, evicting the least recently used key if
+// the cache is full. Keys are not cached if the cache is disabled, either by
+// setting its size or time-to-live to zero.
+func remember(key *Key, user *User) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	if cache.size == 0 || cache.ttl == 0 {
+		return
+	}
+
+	entry := &cacheEntry{key: *key, user: *user, expires: time.Now().Add(cache.ttl)}
+	entry.user.Authkey = ""
+
+	if e, exists := cache.entries[key.Prefix]; exists {
+		e.Value = entry
+		cache.order.MoveToFront(e)
+		return
+	}
+
+	for cache.order.Len() >= cache.size {
+		e := cache.order.Back()
+		cache.order.Remove(e)
+		delete(cache.entries, e.Value.(*cacheEntry).key.Prefix)
+	}
+
+	cache.entries[key.Prefix] = cache.order.PushFront(entry)
+}
+
+// Evict all keys issued to user with id 'id' from the cache.
+func evict(id int) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	for prefix, e := range cache.entries {
+		if e.Value.(*cacheEntry).user.Id == id {
+			cache.order.Remove(e)
+			delete(cache.entries, prefix)
+		}
+	}
+}
+
+// Record time 'key' was last used in its cached copy, so that later lookups do
+// not update the time again before it is due.
+func touched(key *Key) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	if e, exists := cache.entries[key.Prefix]; exists {
+		e.Value.(*cacheEntry).key.LastUsed = key.LastUsed
+	}
+}
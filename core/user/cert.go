@@ -0,0 +1,109 @@
+// Copyright 2012 - 2014 Alex Palaistras. All rights reserved.
+// Use of this source code is governed by the MIT License, the
+// full text of which can be found in the LICENSE file.
+
+package user
+
+import (
+	"fmt"
+	"time"
+)
+
+// AuthCertificate returns user associated with TLS client certificate subject
+// in 'subject', as formatted by 'pkix.Name.String' (e.g. 'CN=app,O=Example'),
+// unless the user is suspended.
+func AuthCertificate(subject string) (*User, error) {
+	query := `SELECT user_id FROM user_certs WHERE subject = ?`
+
+	var id int
+	if error := db.QueryRow(query, subject).Scan(&id); error != nil {
+		return nil, fmt.Errorf("User with certificate subject '%s' did not authenticate: %s", subject, error)
+	}
+
+	user, error := Get(id)
+	if error != nil {
+		return nil, fmt.Errorf("User with certificate subject '%s' did not authenticate: %s", subject, error)
+	} else if error = user.active(); error != nil {
+		return nil, error
+	}
+
+	user.seen(time.Now())
+	return user, nil
+}
+
+// AddCertificate associates TLS client certificate subject in 'subject' with
+// user, allowing clients presenting a valid certificate with that subject to
+// authenticate as the user without an authkey. Subjects may only be associated
+// with a single user.
+func (u *User) AddCertificate(subject string) error {
+	return u.addCertificate(db, subject)
+}
+
+// Associate certificate subject 'subject' with user, running queries with 'q'.
+func (u *User) addCertificate(q Querier, subject string) error {
+	if subject == "" {
+		return fmt.Errorf("Certificate subject is empty.")
+	}
+
+	var id int
+
+	query := `SELECT user_id FROM user_certs WHERE subject = ?`
+	q.QueryRow(query, subject).Scan(&id)
+
+	if id == u.Id {
+		return nil
+	} else if id != 0 {
+		return fmt.Errorf("Certificate subject '%s' is already associated with user with id '%d'.", subject, id)
+	}
+
+	query = `INSERT INTO user_certs (user_id, subject) VALUES (?, ?)`
+	if _, error := q.Exec(query, u.Id, subject); error != nil {
+		return error
+	}
+
+	return nil
+}
+
+// RemoveCertificate removes association with certificate subject previously
+// added by AddCertificate.
+func (u *User) RemoveCertificate(subject string) error {
+	query := `DELETE FROM user_certs WHERE user_id = ? AND subject = ?`
+	result, error := db.Exec(query, u.Id, subject)
+	if error != nil {
+		return error
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("Certificate subject '%s' is not associated with user with id '%d'.", subject, u.Id)
+	}
+
+	return nil
+}
+
+// Certificates returns all certificate subjects associated with user.
+func (u *User) Certificates() ([]string, error) {
+	query := `SELECT subject FROM user_certs WHERE user_id = ? ORDER BY id ASC`
+	rows, error := db.Query(query, u.Id)
+	if error != nil {
+		return nil, error
+	}
+
+	defer rows.Close()
+
+	subjects := make([]string, 0)
+
+	for rows.Next() {
+		var subject string
+		if error = rows.Scan(&subject); error != nil {
+			return nil, error
+		}
+
+		subjects = append(subjects, subject)
+	}
+
+	if error = rows.Err(); error != nil {
+		return nil, error
+	}
+
+	return subjects, nil
+}
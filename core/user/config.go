@@ -8,8 +8,33 @@ import (
 	"github.com/deuill/sleepy/core/config"
 )
 
+// Modules returns names of modules with options set in user's configuration,
+// in order of name.
+func (u *User) Modules() ([]string, error) {
+	query := `SELECT DISTINCT module FROM user_conf WHERE user_id = ? ORDER BY module ASC`
+	rows, error := db.Query(query, u.Id)
+	if error != nil {
+		return nil, error
+	}
+
+	defer rows.Close()
+
+	modules := make([]string, 0)
+
+	for rows.Next() {
+		var module string
+		if error = rows.Scan(&module); error != nil {
+			return nil, error
+		}
+
+		modules = append(modules, module)
+	}
+
+	return modules, rows.Err()
+}
+
 func (u *User) Conf(module string) (*config.Config, error) {
-	query := `SELECT section, option, value FROM user_conf WHERE user_id = ? AND module = ?`
+	query := `SELECT section, ` + db.Quote("option") + `, value FROM user_conf WHERE user_id = ? AND module = ?`
 	rows, error := db.Query(query, u.Id, module)
 	if error != nil {
 		return nil, error
@@ -28,7 +53,10 @@ func (u *User) Conf(module string) (*config.Config, error) {
 			return nil, error
 		}
 
-		conf[section] = make(map[string]interface{})
+		if _, exists := conf[section]; !exists {
+			conf[section] = make(map[string]interface{})
+		}
+
 		conf[section][option] = value
 	}
 
@@ -36,19 +64,24 @@ func (u *User) Conf(module string) (*config.Config, error) {
 }
 
 func (u *User) SetOption(module, section, option string, value interface{}) (bool, error) {
+	return u.setOption(db, module, section, option, value)
+}
+
+// Set option for user, running queries with 'q'.
+func (u *User) setOption(q Querier, module, section, option string, value interface{}) (bool, error) {
 	var exists int
 
-	query := `SELECT EXISTS(SELECT 1 FROM user_conf WHERE user_id = ? AND module = ? AND section = ? AND option = ?)`
-	row := db.QueryRow(query, u.Id, module, section, option)
+	query := `SELECT COUNT(*) FROM user_conf WHERE user_id = ? AND module = ? AND section = ? AND ` + db.Quote("option") + ` = ?`
+	row := q.QueryRow(query, u.Id, module, section, option)
 	row.Scan(&exists)
 
 	if exists > 0 {
-		query = `UPDATE user_conf SET value = ? WHERE user_id = ? AND module = ? AND section = ? AND option = ?`
+		query = `UPDATE user_conf SET value = ? WHERE user_id = ? AND module = ? AND section = ? AND ` + db.Quote("option") + ` = ?`
 	} else {
-		query = `INSERT INTO user_conf (value, user_id, module, section, option) VALUES (?, ?, ?, ?, ?)`
+		query = `INSERT INTO user_conf (value, user_id, module, section, ` + db.Quote("option") + `) VALUES (?, ?, ?, ?, ?)`
 	}
 
-	_, error := db.Exec(query, value, u.Id, module, section, option)
+	_, error := q.Exec(query, value, u.Id, module, section, option)
 	if error != nil {
 		return false, error
 	}
@@ -73,7 +106,7 @@ func (u *User) DeleteOption(module, section, option string) (bool, error) {
 	}
 
 	if option != "" {
-		query = query + ` AND option = ?`
+		query = query + ` AND ` + db.Quote("option") + ` = ?`
 		params = append(params, option)
 	}
 
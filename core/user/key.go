@@ -0,0 +1,426 @@
+// Copyright 2012 - 2014 Alex Palaistras. All rights reserved.
+// Use of this source code is governed by the MIT License, the
+// full text of which can be found in the LICENSE file.
+
+package user
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Length of the public prefix of authkeys, by which keys are looked up.
+const prefixLen = 8
+
+// Time between updates to the time a key was last used, so that keys in heavy
+// use do not result in a write for every request.
+const touchInterval = time.Minute
+
+// Time nonces were last removed from the store after expiring, by this process.
+var nonceSweep struct {
+	sync.Mutex
+	last time.Time
+}
+
+// Key is an authkey issued to a user. The authkey itself is only known when the
+// key is added, and is not stored. Kept instead are a short prefix by which the
+// key is looked up, the hash authkeys are checked against and the key requests
+// are signed with, the latter encrypted with the secret key, as set in the
+// 'secret-file' option.
+type Key struct {
+	Name     string    // Name is the name given to the key, unique for each user.
+	Prefix   string    // Prefix is the first characters of the authkey.
+	Created  time.Time // Created is the time the key was added.
+	Expires  time.Time // Expires is the time the key expires, or zero if it never does.
+	LastUsed time.Time // LastUsed is the time the key was last used, or zero if never used.
+
+	userId int
+	hash   []byte // SHA-256 hash of the signing key.
+	secret []byte // Signing key, encrypted with the secret key.
+	user   *User
+}
+
+// AddKey issues a new authkey named 'name' to user, expiring at 'expires', or
+// never if zero, returning the key and the authkey itself. The authkey cannot
+// be retrieved again afterwards.
+func (u *User) AddKey(name string, expires time.Time) (*Key, string, error) {
+	if name == "" {
+		return nil, "", fmt.Errorf("Key name is empty.")
+	}
+
+	var exists int
+
+	query := `SELECT COUNT(*) FROM user_keys WHERE user_id = ? AND name = ?`
+	db.QueryRow(query, u.Id, name).Scan(&exists)
+
+	if exists > 0 {
+		return nil, "", fmt.Errorf("Key named '%s' already exists for user with id '%d'.", name, u.Id)
+	}
+
+	// Generate random authkey, retrying in the unlikely case of its prefix
+	// matching the prefix of an existing key.
+	for i := 0; i < 3; i++ {
+		buf := make([]byte, 20)
+		if _, error := rand.Read(buf); error != nil {
+			return nil, "", error
+		}
+
+		authkey := hex.EncodeToString(buf)
+		key, error := newKey(name, authkey, u.Id)
+		if error != nil {
+			return nil, "", error
+		}
+
+		key.Expires = expires
+
+		query = `SELECT COUNT(*) FROM user_keys WHERE prefix = ?`
+		db.QueryRow(query, key.Prefix).Scan(&exists)
+
+		if exists > 0 {
+			continue
+		}
+
+		if error := insertKey(db, key); error != nil {
+			return nil, "", error
+		}
+
+		return key, authkey, nil
+	}
+
+	return nil, "", fmt.Errorf("Unable to generate unique authkey.")
+}
+
+// RevokeKey removes key with name or prefix matching 'name' from user. Requests
+// carrying or signed with the key's authkey are rejected from then on.
+func (u *User) RevokeKey(name string) error {
+	query := `DELETE FROM user_keys WHERE user_id = ? AND (name = ? OR prefix = ?)`
+	result, error := db.Exec(query, u.Id, name, name)
+	if error != nil {
+		return error
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("Key '%s' does not exist for user with id '%d'.", name, u.Id)
+	}
+
+	evict(u.Id)
+	return nil
+}
+
+// Keys returns all keys issued to user, including expired keys, in the order
+// they were added.
+func (u *User) Keys() ([]Key, error) {
+	query := `SELECT user_id, name, prefix, hash, secret, created, expires, last_used FROM user_keys WHERE user_id = ? ORDER BY id ASC`
+	rows, error := db.Query(query, u.Id)
+	if error != nil {
+		return nil, error
+	}
+
+	defer rows.Close()
+
+	keys := make([]Key, 0)
+
+	for rows.Next() {
+		key, error := scanKey(rows)
+		if error != nil {
+			return nil, error
+		}
+
+		keys = append(keys, *key)
+	}
+
+	if error = rows.Err(); error != nil {
+		return nil, error
+	}
+
+	return keys, nil
+}
+
+// FindKey returns the unexpired key with prefix 'prefix'. Keys found are cached
+// along with the user they were issued to, as set in the '[users]' section of
+// the configuration.
+func FindKey(prefix string) (*Key, error) {
+	key, user, exists := cached(prefix)
+	if !exists {
+		var error error
+
+		query := `SELECT user_id, name, prefix, hash, secret, created, expires, last_used FROM user_keys WHERE prefix = ?`
+		key, error = scanKey(db.QueryRow(query, prefix))
+		if error == sql.ErrNoRows {
+			return nil, fmt.Errorf("Key with prefix '%s' does not exist.", prefix)
+		} else if error != nil {
+			return nil, fmt.Errorf("Error finding key: %s", error)
+		}
+
+		if user, error = Get(key.userId); error != nil {
+			return nil, error
+		}
+
+		remember(key, user)
+	}
+
+	key.user = user
+
+	if !key.Expires.IsZero() && time.Now().After(key.Expires) {
+		return nil, fmt.Errorf("Key with prefix '%s' has expired.", prefix)
+	}
+
+	return key, nil
+}
+
+// User returns the user the key was issued to, unless the user is suspended.
+func (k *Key) User() (*User, error) {
+	var user *User
+	if k.user != nil {
+		copied := *k.user
+		user = &copied
+	} else {
+		var error error
+		if user, error = Get(k.userId); error != nil {
+			return nil, error
+		}
+	}
+
+	if error := user.active(); error != nil {
+		return nil, error
+	}
+
+	return user, nil
+}
+
+// SigningKey returns the key used for verifying requests signed with the key,
+// which is the SHA-256 hash of the authkey, so that the authkey itself is
+// never sent.
+func (k *Key) SigningKey() ([]byte, error) {
+	if len(k.secret) == 0 {
+		return nil, fmt.Errorf("Key with prefix '%s' cannot be used for signing requests.", k.Prefix)
+	}
+
+	key, error := unseal(k.secret)
+	if error != nil {
+		return nil, fmt.Errorf("Unable to decrypt signing key for key with prefix '%s': %s", k.Prefix, error)
+	}
+
+	return key, nil
+}
+
+// Touch records the key, and the user it was issued to, as having been used.
+func (k *Key) Touch() {
+	now := time.Now()
+	if now.Sub(k.LastUsed) < touchInterval {
+		return
+	}
+
+	query := `UPDATE user_keys SET last_used = ? WHERE prefix = ?`
+	if _, error := db.Exec(query, now.Unix(), k.Prefix); error == nil {
+		k.LastUsed = now
+		touched(k)
+	}
+
+	query = `UPDATE users SET last_seen = ? WHERE id = ?`
+	db.Exec(query, now.Unix(), k.userId)
+}
+
+// UseNonce records 'nonce' as used in a request signed with key, until 'expires',
+// returning false if already recorded. Nonces are kept in the user store, so that
+// signed requests are only accepted once by all instances sharing the store, and
+// across restarts.
+func (k *Key) UseNonce(nonce string, expires time.Time) (bool, error) {
+	now := time.Now()
+
+	nonceSweep.Lock()
+	if now.Sub(nonceSweep.last) > touchInterval {
+		nonceSweep.last = now
+		db.Exec(`DELETE FROM signature_nonces WHERE expires < ?`, now.Unix())
+	}
+	nonceSweep.Unlock()
+
+	// Nonces already recorded fail to be added again, either here or by another
+	// instance at the same time.
+	query := `INSERT INTO signature_nonces (prefix, nonce, expires) VALUES (?, ?, ?)`
+	if _, error := db.Exec(query, k.Prefix, nonce, expires.Unix()); error != nil {
+		var exists int
+
+		query = `SELECT COUNT(*) FROM signature_nonces WHERE prefix = ? AND nonce = ?`
+		if db.QueryRow(query, k.Prefix, nonce).Scan(&exists); exists > 0 {
+			return false, nil
+		}
+
+		return false, error
+	}
+
+	return true, nil
+}
+
+// Check that 'authkey' matches key.
+func (k *Key) matches(authkey string) bool {
+	return subtle.ConstantTimeCompare(hash(authkey), k.hash) == 1
+}
+
+// Return new key named 'name' for 'authkey', issued to user with id 'id'.
+func newKey(name, authkey string, id int) (*Key, error) {
+	signing := digest([]byte(authkey))
+	secret, error := seal(signing)
+	if error != nil {
+		return nil, error
+	}
+
+	return &Key{Name: name, Prefix: prefix(authkey), Created: time.Now(), userId: id, hash: digest(signing), secret: secret}, nil
+}
+
+// Return hash 'authkey' is checked against, the SHA-256 hash of the key signed
+// requests are signed with, itself the SHA-256 hash of the authkey.
+func hash(authkey string) []byte {
+	return digest(digest([]byte(authkey)))
+}
+
+// Return SHA-256 hash of 'data'.
+func digest(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+// Return the prefix by which the key for 'authkey' is looked up.
+func prefix(authkey string) string {
+	if len(authkey) < prefixLen {
+		return authkey
+	}
+
+	return authkey[:prefixLen]
+}
+
+// Insert key into the database, running queries with 'q'.
+func insertKey(q Querier, key *Key) error {
+	var expires, used int64
+	if !key.Expires.IsZero() {
+		expires = key.Expires.Unix()
+	}
+
+	if !key.LastUsed.IsZero() {
+		used = key.LastUsed.Unix()
+	}
+
+	query := `INSERT INTO user_keys (user_id, name, prefix, hash, secret, created, expires, last_used) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	_, error := q.Exec(query, key.userId, key.Name, key.Prefix, hex.EncodeToString(key.hash), hex.EncodeToString(key.secret), key.Created.Unix(), expires, used)
+
+	return error
+}
+
+// Scan key from row in 'row', as selected by the queries above.
+func scanKey(row interface{ Scan(...interface{}) error }) (*Key, error) {
+	var key Key
+	var hashed, secret string
+	var created, expires, used int64
+
+	error := row.Scan(&key.userId, &key.Name, &key.Prefix, &hashed, &secret, &created, &expires, &used)
+	if error != nil {
+		return nil, error
+	}
+
+	if key.hash, error = hex.DecodeString(hashed); error != nil {
+		return nil, error
+	} else if key.secret, error = hex.DecodeString(secret); error != nil {
+		return nil, error
+	}
+
+	key.Created = time.Unix(created, 0)
+	if expires > 0 {
+		key.Expires = time.Unix(expires, 0)
+	}
+
+	if used > 0 {
+		key.LastUsed = time.Unix(used, 0)
+	}
+
+	return &key, nil
+}
+
+// Move authkeys stored in the clear in the 'users' table, as was done before
+// keys were introduced, into hashed keys named 'default'. Keys are stored as
+// they were before signing keys were encrypted, and are upgraded by sealKeys.
+func hashAuthkeys(s *sqlStore, tx *sql.Tx) error {
+	rows, error := tx.Query(`SELECT id, authkey FROM users WHERE authkey IS NOT NULL AND authkey != ''`)
+	if error != nil {
+		return error
+	}
+
+	keys := make([]*Key, 0)
+	for rows.Next() {
+		var id int
+		var authkey string
+
+		if error = rows.Scan(&id, &authkey); error != nil {
+			rows.Close()
+			return error
+		}
+
+		keys = append(keys, &Key{Name: "default", Prefix: prefix(authkey), Created: time.Now(), userId: id, hash: digest([]byte(authkey))})
+	}
+
+	rows.Close()
+	if error = rows.Err(); error != nil {
+		return error
+	}
+
+	for _, key := range keys {
+		query := `INSERT INTO user_keys (user_id, name, prefix, hash, created, expires, last_used) VALUES (?, ?, ?, ?, ?, 0, 0)`
+		if _, error = tx.Exec(query, key.userId, key.Name, key.Prefix, hex.EncodeToString(key.hash), key.Created.Unix()); error != nil {
+			return fmt.Errorf("Unable to hash authkey for user with id '%d': %s", key.userId, error)
+		}
+
+		if _, error = tx.Exec(`UPDATE users SET authkey = '' WHERE id = ?`, key.userId); error != nil {
+			return error
+		}
+	}
+
+	return nil
+}
+
+// Encrypt keys stored as they were before signing keys were encrypted, where
+// the hash stored was the signing key itself, keeping the signing key encrypted
+// and storing its hash in its place.
+func sealKeys(s *sqlStore, tx *sql.Tx) error {
+	rows, error := tx.Query(`SELECT prefix, hash FROM user_keys`)
+	if error != nil {
+		return error
+	}
+
+	keys := make(map[string][]byte)
+	for rows.Next() {
+		var prefix, hashed string
+		if error = rows.Scan(&prefix, &hashed); error != nil {
+			rows.Close()
+			return error
+		}
+
+		if keys[prefix], error = hex.DecodeString(hashed); error != nil {
+			rows.Close()
+			return fmt.Errorf("Key with prefix '%s' has an invalid hash.", prefix)
+		}
+	}
+
+	rows.Close()
+	if error = rows.Err(); error != nil {
+		return error
+	}
+
+	for prefix, signing := range keys {
+		secret, error := seal(signing)
+		if error != nil {
+			return error
+		}
+
+		query := `UPDATE user_keys SET hash = ?, secret = ? WHERE prefix = ?`
+		if _, error = tx.Exec(s.rebind(query), hex.EncodeToString(digest(signing)), hex.EncodeToString(secret), prefix); error != nil {
+			return error
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,189 @@
+// Copyright 2012 - 2014 Alex Palaistras. All rights reserved.
+// Use of this source code is governed by the MIT License, the
+// full text of which can be found in the LICENSE file.
+
+package user
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Migrations for the schema of each store, kept under a directory named after
+// the store's dialect, named '<version>_<name>.sql' and applied in order of
+// version. Versions are shared between dialects, so that stores other than
+// SQLite skip versions for tables only kept in the system database. Migrations
+// are never removed once released, but undone by later migrations if needed.
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+// Functions run after migrations of the same version and dialect, in the same
+// transaction, for changes that cannot be made in SQL alone.
+var migrationHooks = map[string]map[int]func(s *sqlStore, tx *sql.Tx) error{
+	"sqlite":   {1: grantExisting, 2: hashAuthkeys, 5: sealKeys, 9: dropAuditLog},
+	"mysql":    {1: grantExisting, 5: sealKeys},
+	"postgres": {1: grantExisting, 5: sealKeys},
+}
+
+// A single migration of a store's schema.
+type migration struct {
+	version int
+	name    string
+	query   string
+}
+
+// SchemaVersion returns the version of the user store's schema, along with the
+// latest version known, to which Migrate upgrades the schema.
+func SchemaVersion() (int, int, error) {
+	return db.SchemaVersion()
+}
+
+// Migrate applies migrations not yet applied to the user store, returning the
+// schema version before and after. Schemas newer than the latest version known
+// are left untouched.
+func Migrate() (int, int, error) {
+	return db.Migrate()
+}
+
+// Return all migrations known for store, in order of version.
+func (s *sqlStore) migrations() ([]migration, error) {
+	dir := "migrations/" + s.dialect
+
+	files, error := migrationFiles.ReadDir(dir)
+	if error != nil {
+		return nil, error
+	}
+
+	list := make([]migration, 0, len(files))
+	for _, f := range files {
+		n := strings.Index(f.Name(), "_")
+		if n <= 0 {
+			return nil, fmt.Errorf("Migration '%s' is not named '<version>_<name>.sql'.", f.Name())
+		}
+
+		version, error := strconv.Atoi(f.Name()[:n])
+		if error != nil {
+			return nil, fmt.Errorf("Migration '%s' is not named '<version>_<name>.sql'.", f.Name())
+		}
+
+		query, error := migrationFiles.ReadFile(dir + "/" + f.Name())
+		if error != nil {
+			return nil, error
+		}
+
+		list = append(list, migration{version, strings.TrimSuffix(f.Name()[n+1:], ".sql"), string(query)})
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].version < list[j].version
+	})
+
+	return list, nil
+}
+
+func (s *sqlStore) SchemaVersion() (int, int, error) {
+	list, error := s.migrations()
+	if error != nil {
+		return 0, 0, error
+	}
+
+	var current int
+
+	query := `SELECT COALESCE(MAX(version), 0) FROM schema_version`
+	if error = s.QueryRow(query).Scan(&current); error != nil {
+		return 0, 0, error
+	}
+
+	return current, list[len(list)-1].version, nil
+}
+
+// Migrations are applied each in its own transaction, though MySQL does not
+// roll back changes to the schema made in failed transactions.
+func (s *sqlStore) Migrate() (int, int, error) {
+	current, latest, error := s.SchemaVersion()
+	if error != nil {
+		return 0, 0, error
+	} else if current > latest {
+		return current, current, newerSchema(current, latest)
+	}
+
+	list, error := s.migrations()
+	if error != nil {
+		return 0, 0, error
+	}
+
+	from := current
+	for _, m := range list {
+		if m.version <= current {
+			continue
+		}
+
+		if error = s.apply(m); error != nil {
+			return from, current, fmt.Errorf("Error applying migration '%03d_%s': %s", m.version, m.name, error)
+		}
+
+		current = m.version
+	}
+
+	return from, current, nil
+}
+
+// Apply single migration 'm' and record it as applied. Statements are run one
+// at a time, as not all drivers accept several statements in a single query.
+func (s *sqlStore) apply(m migration) error {
+	tx, error := s.DB.Begin()
+	if error != nil {
+		return error
+	}
+
+	for _, stmt := range strings.Split(m.query, ";\n") {
+		if strings.TrimSpace(stmt) == "" {
+			continue
+		}
+
+		if _, error = tx.Exec(stmt); error != nil {
+			tx.Rollback()
+			return error
+		}
+	}
+
+	if hook, exists := migrationHooks[s.dialect][m.version]; exists {
+		if error = hook(s, tx); error != nil {
+			tx.Rollback()
+			return error
+		}
+	}
+
+	query := `INSERT INTO schema_version (version, name, applied) VALUES (?, ?, ?)`
+	if _, error = tx.Exec(s.rebind(query), m.version, m.name, time.Now().Unix()); error != nil {
+		tx.Rollback()
+		return error
+	}
+
+	return tx.Commit()
+}
+
+// Drop the audit log table created in version 3, unless calls have been recorded
+// in it, as the audit package keeps its table in the same database, and creates
+// it again if dropped.
+func dropAuditLog(s *sqlStore, tx *sql.Tx) error {
+	var entries int
+	if error := tx.QueryRow(`SELECT COUNT(*) FROM audit_log`).Scan(&entries); error != nil || entries > 0 {
+		return nil
+	}
+
+	_, error := tx.Exec(`DROP TABLE audit_log`)
+	return error
+}
+
+// Return error for schema at version 'current' being newer than the latest
+// version known.
+func newerSchema(current, latest int) error {
+	return fmt.Errorf("Database schema version %d is newer than the latest version supported, %d; please upgrade Sleepy.", current, latest)
+}
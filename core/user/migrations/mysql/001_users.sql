@@ -0,0 +1,9 @@
+-- Users, their configuration, permissions and certificate subjects. The 'authkey'
+-- column is kept empty, for compatibility with the SQLite schema.
+CREATE TABLE IF NOT EXISTS users (id INTEGER AUTO_INCREMENT PRIMARY KEY, authkey VARCHAR(64) NOT NULL DEFAULT '');
+CREATE TABLE IF NOT EXISTS user_conf (
+	user_id INTEGER, module VARCHAR(255), section VARCHAR(255), `option` VARCHAR(255), value TEXT,
+	INDEX user_conf_user (user_id, module)
+);
+CREATE TABLE IF NOT EXISTS user_perms (id INTEGER AUTO_INCREMENT PRIMARY KEY, user_id INTEGER, permission VARCHAR(255));
+CREATE TABLE IF NOT EXISTS user_certs (id INTEGER AUTO_INCREMENT PRIMARY KEY, user_id INTEGER, subject VARCHAR(255) UNIQUE);
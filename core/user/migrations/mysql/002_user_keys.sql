@@ -0,0 +1,5 @@
+-- Hashed authkeys, of which users may hold several.
+CREATE TABLE IF NOT EXISTS user_keys (
+	id INTEGER AUTO_INCREMENT PRIMARY KEY, user_id INTEGER, name VARCHAR(255), prefix VARCHAR(16) UNIQUE,
+	hash VARCHAR(64), created BIGINT, expires BIGINT, last_used BIGINT, UNIQUE (user_id, name)
+);
@@ -0,0 +1,12 @@
+-- Profiles for users, made up of names, email addresses and labels, the times
+-- users were added and last seen, and whether users are enabled or suspended.
+ALTER TABLE users
+	ADD COLUMN name VARCHAR(255) NOT NULL DEFAULT '',
+	ADD COLUMN email VARCHAR(255) NOT NULL DEFAULT '',
+	ADD COLUMN status VARCHAR(16) NOT NULL DEFAULT 'enabled',
+	ADD COLUMN created BIGINT NOT NULL DEFAULT 0,
+	ADD COLUMN last_seen BIGINT NOT NULL DEFAULT 0;
+CREATE TABLE IF NOT EXISTS user_labels (
+	id INTEGER AUTO_INCREMENT PRIMARY KEY, user_id INTEGER, label VARCHAR(255),
+	UNIQUE (user_id, label), INDEX user_labels_label (label)
+);
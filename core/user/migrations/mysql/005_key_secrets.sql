@@ -0,0 +1,3 @@
+-- Keys requests are signed with, encrypted with the secret key, kept apart from
+-- the hashes authkeys are checked against.
+ALTER TABLE user_keys ADD COLUMN secret VARCHAR(255) NOT NULL DEFAULT '';
@@ -0,0 +1,7 @@
+-- Permissions granted more than once to the same user are removed, keeping the
+-- first, so that each permission is only granted once. MySQL does not allow the
+-- table deleted from in subqueries, other than in derived tables.
+DELETE FROM user_perms WHERE id NOT IN (
+	SELECT id FROM (SELECT MIN(id) AS id FROM user_perms GROUP BY user_id, permission) AS first
+);
+CREATE UNIQUE INDEX user_perms_permission ON user_perms (user_id, permission);
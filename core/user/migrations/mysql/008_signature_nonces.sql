@@ -0,0 +1,6 @@
+-- Nonces used in request signatures accepted recently, shared by all instances
+-- using the same store, so that each signature is only accepted once.
+CREATE TABLE signature_nonces (
+	prefix VARCHAR(16), nonce VARCHAR(64), expires BIGINT, PRIMARY KEY (prefix, nonce),
+	INDEX signature_nonces_expires (expires)
+);
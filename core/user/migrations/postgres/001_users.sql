@@ -0,0 +1,7 @@
+-- Users, their configuration, permissions and certificate subjects. The 'authkey'
+-- column is kept empty, for compatibility with the SQLite schema.
+CREATE TABLE IF NOT EXISTS users (id SERIAL PRIMARY KEY, authkey TEXT NOT NULL DEFAULT '');
+CREATE TABLE IF NOT EXISTS user_conf (user_id INTEGER, module TEXT, section TEXT, "option" TEXT, value TEXT);
+CREATE INDEX IF NOT EXISTS user_conf_user ON user_conf (user_id, module);
+CREATE TABLE IF NOT EXISTS user_perms (id SERIAL PRIMARY KEY, user_id INTEGER, permission TEXT);
+CREATE TABLE IF NOT EXISTS user_certs (id SERIAL PRIMARY KEY, user_id INTEGER, subject TEXT UNIQUE);
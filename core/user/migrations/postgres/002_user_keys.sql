@@ -0,0 +1,5 @@
+-- Hashed authkeys, of which users may hold several.
+CREATE TABLE IF NOT EXISTS user_keys (
+	id SERIAL PRIMARY KEY, user_id INTEGER, name TEXT, prefix TEXT UNIQUE,
+	hash TEXT, created BIGINT, expires BIGINT, last_used BIGINT, UNIQUE (user_id, name)
+);
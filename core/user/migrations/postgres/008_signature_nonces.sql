@@ -0,0 +1,4 @@
+-- Nonces used in request signatures accepted recently, shared by all instances
+-- using the same store, so that each signature is only accepted once.
+CREATE TABLE signature_nonces (prefix TEXT, nonce TEXT, expires BIGINT, PRIMARY KEY (prefix, nonce));
+CREATE INDEX signature_nonces_expires ON signature_nonces (expires);
@@ -0,0 +1,7 @@
+-- Users, their configuration, permissions and certificate subjects. Tables are
+-- only created if missing, as databases made before migrations were introduced
+-- may contain some or all of them.
+CREATE TABLE IF NOT EXISTS users (id INTEGER PRIMARY KEY, authkey TEXT);
+CREATE TABLE IF NOT EXISTS user_conf (user_id INTEGER, module, section, option TEXT, value BLOB);
+CREATE TABLE IF NOT EXISTS user_perms (user_id INTEGER, permission TEXT);
+CREATE TABLE IF NOT EXISTS user_certs (user_id INTEGER, subject TEXT UNIQUE);
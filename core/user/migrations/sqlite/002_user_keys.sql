@@ -0,0 +1,6 @@
+-- Hashed authkeys, of which users may hold several. Authkeys stored in the clear
+-- in the 'users' table are moved here once this migration is applied.
+CREATE TABLE IF NOT EXISTS user_keys (
+	user_id INTEGER, name TEXT, prefix TEXT UNIQUE, hash TEXT,
+	created INTEGER, expires INTEGER, last_used INTEGER, UNIQUE (user_id, name)
+);
@@ -0,0 +1,7 @@
+-- Calls to module methods, as recorded by the audit log.
+CREATE TABLE IF NOT EXISTS audit_log (
+	time INTEGER, user_id INTEGER, module TEXT, method TEXT,
+	duration INTEGER, code INTEGER, error TEXT, params TEXT
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_time ON audit_log (time);
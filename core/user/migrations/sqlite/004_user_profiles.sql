@@ -0,0 +1,9 @@
+-- Profiles for users, made up of names, email addresses and labels, the times
+-- users were added and last seen, and whether users are enabled or suspended.
+ALTER TABLE users ADD COLUMN name TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN email TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN status TEXT NOT NULL DEFAULT 'enabled';
+ALTER TABLE users ADD COLUMN created INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN last_seen INTEGER NOT NULL DEFAULT 0;
+CREATE TABLE IF NOT EXISTS user_labels (user_id INTEGER, label TEXT, UNIQUE (user_id, label));
+CREATE INDEX IF NOT EXISTS user_labels_label ON user_labels (label);
@@ -0,0 +1,20 @@
+-- Ids for keys, permissions and certificate subjects, by which these are listed
+-- in the order they were added, as in other databases. Tables are rebuilt, with
+-- ids taken from the implicit 'rowid' column.
+CREATE TABLE user_perms_new (id INTEGER PRIMARY KEY, user_id INTEGER, permission TEXT);
+INSERT INTO user_perms_new (id, user_id, permission) SELECT rowid, user_id, permission FROM user_perms;
+DROP TABLE user_perms;
+ALTER TABLE user_perms_new RENAME TO user_perms;
+CREATE TABLE user_certs_new (id INTEGER PRIMARY KEY, user_id INTEGER, subject TEXT UNIQUE);
+INSERT INTO user_certs_new (id, user_id, subject) SELECT rowid, user_id, subject FROM user_certs;
+DROP TABLE user_certs;
+ALTER TABLE user_certs_new RENAME TO user_certs;
+CREATE TABLE user_keys_new (
+	id INTEGER PRIMARY KEY, user_id INTEGER, name TEXT, prefix TEXT UNIQUE, hash TEXT,
+	created INTEGER, expires INTEGER, last_used INTEGER, secret TEXT NOT NULL DEFAULT '',
+	UNIQUE (user_id, name)
+);
+INSERT INTO user_keys_new (id, user_id, name, prefix, hash, created, expires, last_used, secret)
+	SELECT rowid, user_id, name, prefix, hash, created, expires, last_used, secret FROM user_keys;
+DROP TABLE user_keys;
+ALTER TABLE user_keys_new RENAME TO user_keys;
@@ -0,0 +1,4 @@
+-- Permissions granted more than once to the same user are removed, keeping the
+-- first, so that each permission is only granted once.
+DELETE FROM user_perms WHERE id NOT IN (SELECT MIN(id) FROM user_perms GROUP BY user_id, permission);
+CREATE UNIQUE INDEX user_perms_permission ON user_perms (user_id, permission);
@@ -0,0 +1,4 @@
+-- The audit log is kept by the audit package, which creates its table in the
+-- system database on startup, and is no longer part of the user store's schema.
+-- The table created in version 3 is dropped by the hook run for this version,
+-- unless calls have been recorded in it.
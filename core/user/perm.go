@@ -0,0 +1,136 @@
+// Copyright 2012 - 2014 Alex Palaistras. All rights reserved.
+// Use of this source code is governed by the MIT License, the
+// full text of which can be found in the LICENSE file.
+
+package user
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// Grant allows user to call methods matching 'perm', which is either a
+// fully-qualified method name (e.g. 'Database.Get'), a wildcard matching
+// all methods in a module (e.g. 'File.*') or a single '*', matching all
+// methods in all modules.
+func (u *User) Grant(perm string) error {
+	return u.grant(db, perm)
+}
+
+// Grant permission 'perm' to user, running queries with 'q'.
+func (u *User) grant(q Querier, perm string) error {
+	if error := checkPermission(perm); error != nil {
+		return error
+	}
+
+	var exists int
+
+	query := `SELECT COUNT(*) FROM user_perms WHERE user_id = ? AND permission = ?`
+	q.QueryRow(query, u.Id, perm).Scan(&exists)
+
+	if exists > 0 {
+		return nil
+	}
+
+	// Permissions granted at the same time elsewhere fail to be added again,
+	// in which case the permission has been granted all the same.
+	query = `INSERT INTO user_perms (user_id, permission) VALUES (?, ?)`
+	if _, error := q.Exec(query, u.Id, perm); error != nil {
+		query = `SELECT COUNT(*) FROM user_perms WHERE user_id = ? AND permission = ?`
+		if q.QueryRow(query, u.Id, perm).Scan(&exists); exists > 0 {
+			return nil
+		}
+
+		return error
+	}
+
+	return nil
+}
+
+// Revoke removes a permission previously given to user by Grant.
+func (u *User) Revoke(perm string) error {
+	query := `DELETE FROM user_perms WHERE user_id = ? AND permission = ?`
+	result, error := db.Exec(query, u.Id, perm)
+	if error != nil {
+		return error
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("Permission '%s' has not been granted to user with id '%d'.", perm, u.Id)
+	}
+
+	return nil
+}
+
+// Permissions returns all permissions granted to user, in the order they
+// were granted.
+func (u *User) Permissions() ([]string, error) {
+	query := `SELECT permission FROM user_perms WHERE user_id = ? ORDER BY id ASC`
+	rows, error := db.Query(query, u.Id)
+	if error != nil {
+		return nil, error
+	}
+
+	defer rows.Close()
+
+	perms := make([]string, 0)
+
+	for rows.Next() {
+		var perm string
+		if error = rows.Scan(&perm); error != nil {
+			return nil, error
+		}
+
+		perms = append(perms, perm)
+	}
+
+	if error = rows.Err(); error != nil {
+		return nil, error
+	}
+
+	return perms, nil
+}
+
+// Can returns true if user has been granted permission to call 'method'
+// in 'module', either directly or by means of a wildcard.
+func (u *User) Can(module, method string) (bool, error) {
+	var exists int
+
+	query := `SELECT COUNT(*) FROM user_perms WHERE user_id = ? AND permission IN (?, ?, ?)`
+	error := db.QueryRow(query, u.Id, module+"."+method, module+".*", "*").Scan(&exists)
+	if error != nil {
+		return false, error
+	}
+
+	return exists > 0, nil
+}
+
+// Grant all permissions to existing users, unless permissions have been granted
+// to any user, as for databases made before permissions were introduced, whose
+// users were allowed to call all methods.
+func grantExisting(s *sqlStore, tx *sql.Tx) error {
+	var perms int
+	if error := tx.QueryRow(`SELECT COUNT(*) FROM user_perms`).Scan(&perms); error != nil {
+		return error
+	} else if perms > 0 {
+		return nil
+	}
+
+	_, error := tx.Exec(`INSERT INTO user_perms (user_id, permission) SELECT id, '*' FROM users`)
+	return error
+}
+
+// Check that permission string is well-formed.
+func checkPermission(perm string) error {
+	if perm == "*" {
+		return nil
+	}
+
+	parts := strings.Split(perm, ".")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || parts[0] == "*" {
+		return fmt.Errorf("Permission '%s' is malformed, expecting 'Module.Method', 'Module.*' or '*'.", perm)
+	}
+
+	return nil
+}
@@ -0,0 +1,255 @@
+// Copyright 2012 - 2014 Alex Palaistras. All rights reserved.
+// Use of this source code is governed by the MIT License, the
+// full text of which can be found in the LICENSE file.
+
+package user
+
+import (
+	"fmt"
+	"net/mail"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Statuses users may be in. Suspended users keep their keys, permissions and
+// configuration, but are not allowed to authenticate until enabled again.
+const (
+	Enabled   = "enabled"
+	Suspended = "suspended"
+)
+
+// Columns selected for users, in the order expected by scanUser.
+const userColumns = `id, authkey, name, email, status, created, last_seen`
+
+// Filter selects users returned by Find. Empty fields match all users.
+type Filter struct {
+	Name   string // Name matches users whose name contains the text given, regardless of case.
+	Email  string // Email matches users whose email address contains the text given, regardless of case.
+	Label  string // Label matches users given the label.
+	Status string // Status matches users in the status given.
+}
+
+// Find returns users matching all fields set in 'filter', in order of id.
+func Find(filter Filter) ([]User, error) {
+	var where []string
+	var args []interface{}
+
+	if filter.Name != "" {
+		where, args = append(where, `LOWER(name) LIKE ?`), append(args, "%"+strings.ToLower(filter.Name)+"%")
+	}
+
+	if filter.Email != "" {
+		where, args = append(where, `LOWER(email) LIKE ?`), append(args, "%"+strings.ToLower(filter.Email)+"%")
+	}
+
+	if filter.Label != "" {
+		where, args = append(where, `id IN (SELECT user_id FROM user_labels WHERE label = ?)`), append(args, filter.Label)
+	}
+
+	if filter.Status != "" {
+		where, args = append(where, `status = ?`), append(args, filter.Status)
+	}
+
+	query := `SELECT ` + userColumns + ` FROM users`
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, " AND ")
+	}
+
+	rows, error := db.Query(query+` ORDER BY id ASC`, args...)
+	if error != nil {
+		return nil, fmt.Errorf("Error fetching user list: %s", error)
+	}
+
+	defer rows.Close()
+
+	users := make([]User, 0)
+
+	for rows.Next() {
+		user, error := scanUser(rows)
+		if error != nil {
+			return nil, fmt.Errorf("Error fetching user list: %s", error)
+		}
+
+		users = append(users, *user)
+	}
+
+	if error = rows.Err(); error != nil {
+		return nil, error
+	}
+
+	// Labels are fetched once all users are read, as not all drivers allow
+	// queries to be run while rows are still being read.
+	for i := range users {
+		if users[i].Labels, error = labels(users[i].Id); error != nil {
+			return nil, error
+		}
+	}
+
+	return users, nil
+}
+
+// Update saves the name, email address, labels and status set for user.
+// Labels are trimmed of surrounding whitespace and sorted, and duplicate
+// labels removed.
+func (u *User) Update() error {
+	return u.update(db)
+}
+
+// Update profile for user, running queries with 'q'.
+func (u *User) update(q Querier) error {
+	if u.Status == "" {
+		u.Status = Enabled
+	} else if u.Status != Enabled && u.Status != Suspended {
+		return fmt.Errorf("Status '%s' is not valid, expecting '%s' or '%s'.", u.Status, Enabled, Suspended)
+	}
+
+	if u.Email != "" {
+		if _, error := mail.ParseAddress(u.Email); error != nil {
+			return fmt.Errorf("Email address '%s' is not valid.", u.Email)
+		}
+	}
+
+	labels, error := cleanLabels(u.Labels)
+	if error != nil {
+		return error
+	}
+
+	query := `UPDATE users SET name = ?, email = ?, status = ? WHERE id = ?`
+	if _, error = q.Exec(query, u.Name, u.Email, u.Status, u.Id); error != nil {
+		return error
+	}
+
+	query = `DELETE FROM user_labels WHERE user_id = ?`
+	if _, error = q.Exec(query, u.Id); error != nil {
+		return error
+	}
+
+	query = `INSERT INTO user_labels (user_id, label) VALUES (?, ?)`
+	for _, label := range labels {
+		if _, error = q.Exec(query, u.Id, label); error != nil {
+			return error
+		}
+	}
+
+	u.Labels = labels
+	evict(u.Id)
+
+	return nil
+}
+
+// Suspend prevents user from authenticating until enabled again. Requests made
+// by the user are rejected from then on, though calls already in progress are
+// allowed to complete.
+func (u *User) Suspend() error {
+	return u.setStatus(Suspended)
+}
+
+// Enable allows suspended user to authenticate again.
+func (u *User) Enable() error {
+	return u.setStatus(Enabled)
+}
+
+// Set status of user to 'status'.
+func (u *User) setStatus(status string) error {
+	query := `UPDATE users SET status = ? WHERE id = ?`
+	if _, error := db.Exec(query, status, u.Id); error != nil {
+		return error
+	}
+
+	u.Status = status
+	evict(u.Id)
+
+	return nil
+}
+
+// Check that user is allowed to authenticate.
+func (u *User) active() error {
+	if u.Status == Suspended {
+		return fmt.Errorf("User with id '%d' is suspended.", u.Id)
+	}
+
+	return nil
+}
+
+// Record user as having authenticated at 'now', unless recorded recently.
+func (u *User) seen(now time.Time) {
+	if now.Sub(u.LastSeen) < touchInterval {
+		return
+	}
+
+	query := `UPDATE users SET last_seen = ? WHERE id = ?`
+	if _, error := db.Exec(query, now.Unix(), u.Id); error == nil {
+		u.LastSeen = now
+	}
+}
+
+// Return labels given to user with id 'id', in order.
+func labels(id int) ([]string, error) {
+	query := `SELECT label FROM user_labels WHERE user_id = ? ORDER BY label ASC`
+	rows, error := db.Query(query, id)
+	if error != nil {
+		return nil, error
+	}
+
+	defer rows.Close()
+
+	labels := make([]string, 0)
+
+	for rows.Next() {
+		var label string
+		if error = rows.Scan(&label); error != nil {
+			return nil, error
+		}
+
+		labels = append(labels, label)
+	}
+
+	return labels, rows.Err()
+}
+
+// Return labels in 'labels' trimmed, sorted and with duplicates removed. Labels
+// may not be empty or contain commas, by which labels are separated on the
+// command line.
+func cleanLabels(labels []string) ([]string, error) {
+	seen := make(map[string]bool, len(labels))
+	result := make([]string, 0, len(labels))
+
+	for _, label := range labels {
+		label = strings.TrimSpace(label)
+		if label == "" {
+			return nil, fmt.Errorf("Label is empty.")
+		} else if strings.Contains(label, ",") {
+			return nil, fmt.Errorf("Label '%s' contains a comma.", label)
+		}
+
+		if !seen[label] {
+			seen[label] = true
+			result = append(result, label)
+		}
+	}
+
+	sort.Strings(result)
+	return result, nil
+}
+
+// Scan user from row in 'row', as selected by 'userColumns'.
+func scanUser(row interface{ Scan(...interface{}) error }) (*User, error) {
+	var user User
+	var created, seen int64
+
+	error := row.Scan(&user.Id, &user.Authkey, &user.Name, &user.Email, &user.Status, &created, &seen)
+	if error != nil {
+		return nil, error
+	}
+
+	if created > 0 {
+		user.Created = time.Unix(created, 0)
+	}
+
+	if seen > 0 {
+		user.LastSeen = time.Unix(seen, 0)
+	}
+
+	return &user, nil
+}
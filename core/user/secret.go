@@ -0,0 +1,90 @@
+// Copyright 2012 - 2014 Alex Palaistras. All rights reserved.
+// Use of this source code is governed by the MIT License, the
+// full text of which can be found in the LICENSE file.
+
+package user
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/deuill/sleepy/core/config"
+)
+
+// Cipher used for encrypting keys requests are signed with, as kept in the user
+// store, so that these cannot be recovered from the store alone.
+var secret cipher.AEAD
+
+// Load secret key from the file set in the 'secret-file' option, under the
+// '[users]' section in 'conf', relative to 'datadir' unless absolute. The file
+// is created with a random key if it does not exist.
+func setSecret(datadir string, conf *config.Config) error {
+	path, error := conf.String("users", "secret-file")
+	if error != nil || path == "" {
+		path = "secret.key"
+	}
+
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(datadir, path)
+	}
+
+	data, error := os.ReadFile(path)
+	if os.IsNotExist(error) {
+		buf := make([]byte, 32)
+		if _, error = rand.Read(buf); error != nil {
+			return error
+		}
+
+		data = []byte(hex.EncodeToString(buf) + "\n")
+		if error = os.WriteFile(path, data, 0600); error != nil {
+			return fmt.Errorf("Unable to create secret key file '%s': %s", path, error)
+		}
+	} else if error != nil {
+		return fmt.Errorf("Unable to read secret key file '%s': %s", path, error)
+	}
+
+	key, error := hex.DecodeString(strings.TrimSpace(string(data)))
+	if error != nil || len(key) != 32 {
+		return fmt.Errorf("Secret key file '%s' does not contain a 64-character hexadecimal key.", path)
+	}
+
+	block, error := aes.NewCipher(key)
+	if error != nil {
+		return error
+	}
+
+	secret, error = cipher.NewGCM(block)
+	return error
+}
+
+// Return 'plain' encrypted with the secret key.
+func seal(plain []byte) ([]byte, error) {
+	if secret == nil {
+		return nil, fmt.Errorf("Secret key is not loaded.")
+	}
+
+	nonce := make([]byte, secret.NonceSize())
+	if _, error := rand.Read(nonce); error != nil {
+		return nil, error
+	}
+
+	return secret.Seal(nonce, nonce, plain, nil), nil
+}
+
+// Return 'sealed', as encrypted by seal, decrypted with the secret key.
+func unseal(sealed []byte) ([]byte, error) {
+	if secret == nil {
+		return nil, fmt.Errorf("Secret key is not loaded.")
+	} else if len(sealed) < secret.NonceSize() {
+		return nil, fmt.Errorf("Encrypted value is too short.")
+	}
+
+	n := secret.NonceSize()
+	return secret.Open(nil, sealed[:n], sealed[n:], nil)
+}
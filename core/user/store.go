@@ -0,0 +1,192 @@
+// Copyright 2012 - 2014 Alex Palaistras. All rights reserved.
+// Use of this source code is governed by the MIT License, the
+// full text of which can be found in the LICENSE file.
+
+package user
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/deuill/sleepy/core/config"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Store is the database users, their keys, permissions and configuration are
+// kept in. Queries are written with '?' placeholders, which are rewritten as
+// needed by stores for other databases, and identifiers that are reserved words
+// in some databases are quoted via Quote.
+type Store interface {
+	Querier
+
+	// Begin starts a transaction, in which queries are run until the
+	// transaction is committed or rolled back.
+	Begin() (Tx, error)
+
+	// SchemaVersion returns the version of the store's schema, along with the
+	// latest version known.
+	SchemaVersion() (int, int, error)
+
+	// Migrate upgrades the store's schema to the latest version known,
+	// returning the versions before and after.
+	Migrate() (int, int, error)
+
+	// Quote returns identifier 'name' quoted for the store's database.
+	Quote(name string) string
+
+	Ping() error
+	Close() error
+}
+
+// Querier runs queries against the user store, either directly or as part of a
+// transaction.
+type Querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+
+	// Insert runs INSERT query, returning the id of the row inserted.
+	Insert(query string, args ...interface{}) (int64, error)
+}
+
+// Tx is a transaction on the user store, as started by Store.Begin.
+type Tx interface {
+	Querier
+
+	Commit() error
+	Rollback() error
+}
+
+// A store backed by an SQL database, either SQLite, MySQL or PostgreSQL, as
+// named in 'dialect'.
+type sqlStore struct {
+	*sql.DB
+	dialect string
+}
+
+// Open store named 'name' in 'conf', which is either the system database in
+// 'filename', under 'datadir', for 'sqlite', or the database set in the 'dsn'
+// option for 'mysql' and 'postgres'.
+func openStore(name, datadir, filename string, conf *config.Config) (*sqlStore, error) {
+	var driver, dsn string
+
+	switch name {
+	case "", "sqlite":
+		name, driver, dsn = "sqlite", "sqlite3", datadir+"/"+filename
+	case "mysql", "postgres":
+		if dsn = conf.S("users", "dsn"); dsn == "" {
+			return nil, fmt.Errorf("No data source set for store '%s', please set the 'dsn' option.", name)
+		}
+
+		driver = name
+	default:
+		return nil, fmt.Errorf("Store '%s' is not supported, expecting 'sqlite', 'mysql' or 'postgres'.", name)
+	}
+
+	db, error := sql.Open(driver, dsn)
+	if error != nil {
+		return nil, error
+	}
+
+	return &sqlStore{db, name}, nil
+}
+
+func (s *sqlStore) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return s.DB.Exec(s.rebind(query), args...)
+}
+
+func (s *sqlStore) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return s.DB.Query(s.rebind(query), args...)
+}
+
+func (s *sqlStore) QueryRow(query string, args ...interface{}) *sql.Row {
+	return s.DB.QueryRow(s.rebind(query), args...)
+}
+
+func (s *sqlStore) Insert(query string, args ...interface{}) (int64, error) {
+	return insert(s, s.dialect, query, args...)
+}
+
+func (s *sqlStore) Begin() (Tx, error) {
+	tx, error := s.DB.Begin()
+	if error != nil {
+		return nil, error
+	}
+
+	return &sqlTx{tx, s}, nil
+}
+
+// A transaction on a store backed by an SQL database.
+type sqlTx struct {
+	*sql.Tx
+	store *sqlStore
+}
+
+func (t *sqlTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return t.Tx.Exec(t.store.rebind(query), args...)
+}
+
+func (t *sqlTx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return t.Tx.Query(t.store.rebind(query), args...)
+}
+
+func (t *sqlTx) QueryRow(query string, args ...interface{}) *sql.Row {
+	return t.Tx.QueryRow(t.store.rebind(query), args...)
+}
+
+func (t *sqlTx) Insert(query string, args ...interface{}) (int64, error) {
+	return insert(t, t.store.dialect, query, args...)
+}
+
+// Run INSERT query with 'q' for database of dialect 'dialect', returning the id
+// of the row inserted.
+func insert(q Querier, dialect, query string, args ...interface{}) (int64, error) {
+	var id int64
+
+	// PostgreSQL does not report ids for rows inserted, which are to be
+	// returned by the query itself.
+	if dialect == "postgres" {
+		error := q.QueryRow(query+" RETURNING id", args...).Scan(&id)
+		return id, error
+	}
+
+	result, error := q.Exec(query, args...)
+	if error != nil {
+		return 0, error
+	}
+
+	return result.LastInsertId()
+}
+
+func (s *sqlStore) Quote(name string) string {
+	if s.dialect == "mysql" {
+		return "`" + name + "`"
+	}
+
+	return `"` + name + `"`
+}
+
+// Rewrite '?' placeholders in query for the store's database.
+func (s *sqlStore) rebind(query string) string {
+	if s.dialect != "postgres" {
+		return query
+	}
+
+	var buf strings.Builder
+	for i, n := 0, 1; i < len(query); i++ {
+		if query[i] != '?' {
+			buf.WriteByte(query[i])
+			continue
+		}
+
+		buf.WriteString("$" + strconv.Itoa(n))
+		n++
+	}
+
+	return buf.String()
+}
@@ -7,73 +7,72 @@
 package user
 
 import (
-	"crypto/rand"
-	"crypto/sha1"
-	"database/sql"
 	"fmt"
-	"io"
+	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/deuill/sleepy/core/config"
 )
 
-var db *sql.DB
+var db Store
 
 type User struct {
 	// Contains private or unexported fields.
-	Id      int
-	Authkey string
+	Id       int
+	Authkey  string    // Authkey is only set for users returned by Save or Auth.
+	Name     string    // Name is the name the user is shown as.
+	Email    string    // Email is the address the user is contacted at.
+	Labels   []string  // Labels are free-form labels given to the user, in order.
+	Status   string    // Status is either 'enabled' or 'suspended'.
+	Created  time.Time // Created is the time the user was added, or zero if unknown.
+	LastSeen time.Time // LastSeen is the time the user last authenticated, or zero if never.
 }
 
 func Get(id int) (*User, error) {
-	user := new(User)
-
-	query := `SELECT id, authkey FROM users WHERE id = ?`
-	error := db.QueryRow(query, id).Scan(&user.Id, &user.Authkey)
+	query := `SELECT ` + userColumns + ` FROM users WHERE id = ?`
+	user, error := scanUser(db.QueryRow(query, id))
 	if error != nil {
 		return nil, fmt.Errorf("User with id '%d' not found.", id)
 	}
 
-	return user, nil
-}
-
-func Save() (*User, error) {
-	// Generate random SHA1 authkey.
-	buf := sha1.New()
-
-	_, error := io.CopyN(buf, rand.Reader, 20)
-	if error != nil {
+	if user.Labels, error = labels(user.Id); error != nil {
 		return nil, error
 	}
 
-	auth := fmt.Sprintf("%x", buf.Sum(nil))
+	return user, nil
+}
 
+// Save adds a new user, issued a single key named 'default', which does not
+// expire.
+func Save() (*User, error) {
 	// Create user.
-	query := `INSERT INTO users (authkey) VALUES (?)`
-	result, error := db.Exec(query, auth)
+	created := time.Unix(time.Now().Unix(), 0)
+
+	query := `INSERT INTO users (authkey, status, created) VALUES ('', ?, ?)`
+	id, error := db.Insert(query, Enabled, created.Unix())
 	if error != nil {
 		return nil, error
 	}
 
-	var id int64
+	var user = &User{Id: int(id), Labels: []string{}, Status: Enabled, Created: created}
 
-	if id, error = result.LastInsertId(); error != nil {
+	if _, user.Authkey, error = user.AddKey("default", time.Time{}); error != nil {
 		return nil, error
 	}
 
-	var user = &User{
-		int(id),
-		auth,
-	}
-
 	return user, nil
 }
 
 func Remove(id int) (bool, error) {
+	return remove(db, id)
+}
+
+// Remove user with id 'id', running queries with 'q'.
+func remove(q Querier, id int) (bool, error) {
 	var exists int
 
 	// Check if user already exists.
 	query := `SELECT id FROM users WHERE id = ?`
-	db.QueryRow(query, id).Scan(&exists)
+	q.QueryRow(query, id).Scan(&exists)
 
 	if exists == 0 {
 		return false, fmt.Errorf("User does not exist")
@@ -81,51 +80,105 @@ func Remove(id int) (bool, error) {
 
 	// Delete user.
 	query = `DELETE FROM users WHERE id = ?`
-	_, error := db.Exec(query, id)
+	_, error := q.Exec(query, id)
+	if error != nil {
+		return false, error
+	}
+
+	// Delete user keys.
+	query = `DELETE FROM user_keys WHERE user_id = ?`
+	_, error = q.Exec(query, id)
 	if error != nil {
 		return false, error
 	}
 
 	// Delete user options.
 	query = `DELETE FROM user_conf WHERE user_id = ?`
-	_, error = db.Exec(query, id)
+	_, error = q.Exec(query, id)
 	if error != nil {
 		return false, error
 	}
 
-	return true, nil
-}
-
-func List() ([]User, error) {
-	// Execute query.
-	rows, error := db.Query(`SELECT id, authkey FROM users ORDER BY id ASC`)
+	// Delete user permissions.
+	query = `DELETE FROM user_perms WHERE user_id = ?`
+	_, error = q.Exec(query, id)
 	if error != nil {
-		return nil, fmt.Errorf("Error fetching user list: %s", error)
+		return false, error
 	}
 
-	users := make([]User, 0)
-
-	for i := 0; rows.Next(); i++ {
-		user := User{}
-		rows.Scan(&user.Id, &user.Authkey)
-		users = append(users, user)
+	// Delete user certificate subjects.
+	query = `DELETE FROM user_certs WHERE user_id = ?`
+	_, error = q.Exec(query, id)
+	if error != nil {
+		return false, error
 	}
 
-	if error = rows.Err(); error != nil {
-		return nil, error
+	// Delete user labels.
+	query = `DELETE FROM user_labels WHERE user_id = ?`
+	_, error = q.Exec(query, id)
+	if error != nil {
+		return false, error
 	}
 
-	return users, nil
+	// Forget keys issued to user.
+	evict(id)
+
+	return true, nil
 }
 
-func Setup(datadir, filename string) error {
+// List returns all users, in order of id.
+func List() ([]User, error) {
+	return Find(Filter{})
+}
+
+// Ping checks that the user store is reachable.
+func Ping() error {
+	return db.Ping()
+}
+
+// Close closes the connection to the user store.
+func Close() error {
+	return db.Close()
+}
+
+// Setup connects to the user store set in 'conf', which defaults to the system
+// database in 'filename', under 'datadir'.
+func Setup(datadir, filename string, conf *config.Config) error {
 	var error error
 
-	// Connect to system database.
-	db, error = sql.Open("sqlite3", datadir+"/"+filename)
+	// Load secret key signing keys are encrypted with.
+	if error = setSecret(datadir, conf); error != nil {
+		return error
+	}
+
+	// Connect to user store.
+	db, error = openStore(conf.S("users", "store"), datadir, filename, conf)
+	if error != nil {
+		return fmt.Errorf("Error initializing database: %s\n", error)
+	}
+
+	// Create table for schema versions applied, if not already present. The
+	// schema itself is created and upgraded by Migrate.
+	query := `CREATE TABLE IF NOT EXISTS schema_version (version INTEGER PRIMARY KEY, name VARCHAR(255), applied BIGINT)`
+	if _, error = db.Exec(query); error != nil {
+		return fmt.Errorf("Error initializing database: %s\n", error)
+	}
+
+	// Refuse to work with schemas made by newer versions of Sleepy, which we
+	// cannot be expected to understand.
+	current, latest, error := SchemaVersion()
 	if error != nil {
 		return fmt.Errorf("Error initializing database: %s\n", error)
+	} else if current > latest {
+		return newerSchema(current, latest)
 	}
 
+	setCache(conf)
 	return nil
 }
+
+// Reload applies settings for the key cache in 'conf', emptying the cache, so
+// that changes made to users by other processes take effect immediately.
+func Reload(conf *config.Config) {
+	setCache(conf)
+}
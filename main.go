@@ -8,20 +8,29 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
-	"net/rpc"
-	"net/rpc/jsonrpc"
 	"os"
 	"os/signal"
+	osuser "os/user"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/deuill/sleepy/core/audit"
 	"github.com/deuill/sleepy/core/config"
+	"github.com/deuill/sleepy/core/metrics"
 	"github.com/deuill/sleepy/core/server"
 	"github.com/deuill/sleepy/core/user"
 
@@ -40,6 +49,15 @@ var flags struct {
 	connections int64
 }
 
+// Run-time state for the server, as set up in 'setup'.
+var state struct {
+	http    *http.Server
+	metrics *http.Server
+	pidfile string
+	timeout time.Duration
+	queue   chan bool // Slots for RPC connections, limited by 'max-connections'.
+}
+
 var rootCmd = &cobra.Command{
 	Use:   "sleepyd",
 	Short: "Sleepy - the lightweight web application server",
@@ -64,6 +82,14 @@ var userCmd = &cobra.Command{
 				os.Exit(1)
 			}
 
+			if profileFlags(cmd, u, "label") {
+				if err = u.Update(); err != nil {
+					user.Remove(u.Id)
+					fmt.Printf("Unable to add user: %s\n", err)
+					os.Exit(1)
+				}
+			}
+
 			fmt.Printf("User with id '%d', authkey '%s' added successfully.\n", u.Id, u.Authkey)
 			os.Exit(0)
 		}
@@ -76,20 +102,35 @@ var userCmd = &cobra.Command{
 				os.Exit(1)
 			}
 
+			notify()
 			fmt.Printf("User with id '%d' removed successfully.\n", id)
 			os.Exit(0)
 		}
 
 		if cmd.Flags().Lookup("list").Changed {
-			l, err := user.List()
+			var filter user.Filter
+			filter.Name, _ = cmd.Flags().GetString("name")
+			filter.Email, _ = cmd.Flags().GetString("email")
+			filter.Label, _ = cmd.Flags().GetString("label")
+			filter.Status, _ = cmd.Flags().GetString("status")
+
+			l, err := user.Find(filter)
 			if err != nil {
 				fmt.Printf("Unable to list users: %s\n", err)
 				os.Exit(1)
 			}
 
-			fmt.Println("#\tID\tAuthkey")
+			fmt.Println("#\tID\tName\tEmail\tStatus\tLabels\tLast seen\tKeys\tPermissions")
 			for i, u := range l {
-				fmt.Printf("%d\t%d\t%s\n", (i + 1), u.Id, u.Authkey)
+				var prefixes []string
+				keys, _ := u.Keys()
+				for _, k := range keys {
+					prefixes = append(prefixes, k.Prefix)
+				}
+
+				perms, _ := u.Permissions()
+				fmt.Printf("%d\t%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", (i + 1), u.Id, u.Name, u.Email, u.Status,
+					strings.Join(u.Labels, ","), formatTime(u.LastSeen), strings.Join(prefixes, ","), strings.Join(perms, ","))
 			}
 
 			os.Exit(0)
@@ -97,6 +138,776 @@ var userCmd = &cobra.Command{
 	},
 }
 
+// Set name, email address and labels for user 'u' from flags set for 'cmd',
+// with labels set in flag named 'labels', returning true if any were set.
+func profileFlags(cmd *cobra.Command, u *user.User, labels string) bool {
+	var changed bool
+	if f := cmd.Flags().Lookup("name"); f.Changed {
+		u.Name, changed = f.Value.String(), true
+	}
+
+	if f := cmd.Flags().Lookup("email"); f.Changed {
+		u.Email, changed = f.Value.String(), true
+	}
+
+	if f := cmd.Flags().Lookup(labels); f.Changed {
+		u.Labels, changed = []string{}, true
+		if v := f.Value.String(); v != "" {
+			u.Labels = strings.Split(v, ",")
+		}
+	}
+
+	return changed
+}
+
+var userShowCmd = &cobra.Command{
+	Use:   "show <id>",
+	Short: "Shows profile, keys and permissions for a user",
+	Run: func(cmd *cobra.Command, args []string) {
+		u, _ := userArgs(cmd, args, 1)
+
+		var prefixes []string
+		keys, _ := u.Keys()
+		for _, k := range keys {
+			prefixes = append(prefixes, k.Prefix)
+		}
+
+		perms, _ := u.Permissions()
+
+		// Users added before profiles were introduced have no creation time.
+		created := formatTime(u.Created)
+		if u.Created.IsZero() {
+			created = "unknown"
+		}
+
+		fmt.Printf("ID:\t\t%d\n", u.Id)
+		fmt.Printf("Name:\t\t%s\n", u.Name)
+		fmt.Printf("Email:\t\t%s\n", u.Email)
+		fmt.Printf("Status:\t\t%s\n", u.Status)
+		fmt.Printf("Labels:\t\t%s\n", strings.Join(u.Labels, ","))
+		fmt.Printf("Created:\t%s\n", created)
+		fmt.Printf("Last seen:\t%s\n", formatTime(u.LastSeen))
+		fmt.Printf("Keys:\t\t%s\n", strings.Join(prefixes, ","))
+		fmt.Printf("Permissions:\t%s\n", strings.Join(perms, ","))
+	},
+}
+
+var userUpdateCmd = &cobra.Command{
+	Use:   "update <id>",
+	Short: "Updates name, email address or labels for a user",
+	Long: `Updates name, email address or labels for a user. Options not given are kept
+as they are, while labels given replace all labels for the user. Labels are
+separated by commas, and an empty list removes all labels.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		u, _ := userArgs(cmd, args, 1)
+		if !profileFlags(cmd, u, "labels") {
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		if err := u.Update(); err != nil {
+			fmt.Printf("Unable to update user: %s\n", err)
+			os.Exit(1)
+		}
+
+		notify()
+		fmt.Printf("User with id '%d' updated successfully.\n", u.Id)
+	},
+}
+
+var userSuspendCmd = &cobra.Command{
+	Use:   "suspend <id>",
+	Short: "Prevents a user from authenticating, keeping the user's data in place",
+	Long: `Prevents a user from authenticating until enabled again, keeping the user's
+keys, permissions, configuration and files in place. Servers running locally
+reject requests made by the user at once, and servers on other hosts sharing
+the user store once the user's keys expire from memory, as set in the
+'cache-ttl' option.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		u, _ := userArgs(cmd, args, 1)
+		if err := u.Suspend(); err != nil {
+			fmt.Printf("Unable to suspend user: %s\n", err)
+			os.Exit(1)
+		}
+
+		notify()
+		fmt.Printf("User with id '%d' suspended successfully.\n", u.Id)
+	},
+}
+
+var userEnableCmd = &cobra.Command{
+	Use:   "enable <id>",
+	Short: "Allows a suspended user to authenticate again",
+	Run: func(cmd *cobra.Command, args []string) {
+		u, _ := userArgs(cmd, args, 1)
+		if err := u.Enable(); err != nil {
+			fmt.Printf("Unable to enable user: %s\n", err)
+			os.Exit(1)
+		}
+
+		notify()
+		fmt.Printf("User with id '%d' enabled successfully.\n", u.Id)
+	},
+}
+
+var userGrantCmd = &cobra.Command{
+	Use:   "grant <id> <permission>...",
+	Short: "Grants permission to call module methods to a user",
+	Long: `Grants permission to call module methods to a user. Permissions are either
+fully-qualified method names (e.g. 'Database.Get'), module wildcards (e.g.
+'File.*') or a single '*', allowing calls to all methods in all modules.
+Logins to the FTP server require permission for 'FTP.Login'.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		u, perms := userArgs(cmd, args, 2)
+		for _, p := range perms {
+			if err := u.Grant(p); err != nil {
+				fmt.Printf("Unable to grant permission: %s\n", err)
+				os.Exit(1)
+			}
+		}
+
+		fmt.Printf("Permissions granted to user with id '%d' successfully.\n", u.Id)
+	},
+}
+
+var userRevokeCmd = &cobra.Command{
+	Use:   "revoke <id> <permission>...",
+	Short: "Revokes permission to call module methods from a user",
+	Run: func(cmd *cobra.Command, args []string) {
+		u, perms := userArgs(cmd, args, 2)
+		for _, p := range perms {
+			if err := u.Revoke(p); err != nil {
+				fmt.Printf("Unable to revoke permission: %s\n", err)
+				os.Exit(1)
+			}
+		}
+
+		fmt.Printf("Permissions revoked from user with id '%d' successfully.\n", u.Id)
+	},
+}
+
+// Set up local environment and parse user id and further arguments from command
+// arguments, of which at least 'n' are expected, exiting on any error.
+func userArgs(cmd *cobra.Command, args []string, n int) (*user.User, []string) {
+	if len(args) < n {
+		cmd.Usage()
+		os.Exit(1)
+	}
+
+	if _, err := setup(flags.config, false); err != nil {
+		fmt.Printf("Unable to initialize environment: %s\n", err)
+		os.Exit(1)
+	}
+
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		fmt.Printf("Invalid user id '%s'.\n", args[0])
+		os.Exit(1)
+	}
+
+	u, err := user.Get(id)
+	if err != nil {
+		fmt.Printf("Unable to find user: %s\n", err)
+		os.Exit(1)
+	}
+
+	return u, args[1:]
+}
+
+var userCertCmd = &cobra.Command{
+	Use:   "cert",
+	Short: "Manages TLS client certificates users can authenticate with",
+	Long: `Manages TLS client certificates users can authenticate with. Certificates are
+identified by their subject, as formatted in RFC 2253 (e.g. 'CN=app,O=Example'),
+and must be signed by an authority listed in the 'tls-client-ca' option.`,
+}
+
+var userCertAddCmd = &cobra.Command{
+	Use:   "add <id> <subject>",
+	Short: "Allows user to authenticate with certificate matching subject",
+	Run: func(cmd *cobra.Command, args []string) {
+		u, subject := userArgs(cmd, args, 2)
+		if err := u.AddCertificate(strings.Join(subject, " ")); err != nil {
+			fmt.Printf("Unable to add certificate: %s\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("Certificate added to user with id '%d' successfully.\n", u.Id)
+	},
+}
+
+var userCertRemoveCmd = &cobra.Command{
+	Use:   "remove <id> <subject>",
+	Short: "Removes certificate previously added to user",
+	Run: func(cmd *cobra.Command, args []string) {
+		u, subject := userArgs(cmd, args, 2)
+		if err := u.RemoveCertificate(strings.Join(subject, " ")); err != nil {
+			fmt.Printf("Unable to remove certificate: %s\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("Certificate removed from user with id '%d' successfully.\n", u.Id)
+	},
+}
+
+var userCertListCmd = &cobra.Command{
+	Use:   "list <id>",
+	Short: "Lists certificate subjects added to user",
+	Run: func(cmd *cobra.Command, args []string) {
+		u, _ := userArgs(cmd, args, 1)
+		subjects, err := u.Certificates()
+		if err != nil {
+			fmt.Printf("Unable to list certificates: %s\n", err)
+			os.Exit(1)
+		}
+
+		for _, s := range subjects {
+			fmt.Println(s)
+		}
+	},
+}
+
+var userKeyCmd = &cobra.Command{
+	Use:   "key",
+	Short: "Manages authkeys issued to users",
+	Long: `Manages authkeys issued to users. Users may hold several keys, each with a
+unique name, so that keys can be rotated by adding a new key and revoking the
+old key once clients have moved over. Keys are identified by name or by the
+first characters of the authkey, as printed by 'sleepyd user key list'.`,
+}
+
+var userKeyAddCmd = &cobra.Command{
+	Use:   "add <id> <name>",
+	Short: "Issues new authkey to user",
+	Long: `Issues new authkey to user. Times passed to '--expires' are either in RFC 3339
+format (e.g. '2014-06-01T12:00:00Z'), dates (e.g. '2014-06-01') or durations
+relative to the current time (e.g. '720h'). The authkey is printed once, and
+cannot be retrieved again.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		u, name := userArgs(cmd, args, 2)
+
+		var expires time.Time
+		if v, _ := cmd.Flags().GetString("expires"); v != "" {
+			if d, err := time.ParseDuration(v); err == nil {
+				expires = time.Now().Add(d)
+			} else if expires, err = parseTime(v); err != nil {
+				fmt.Printf("Invalid time '%s' for '--expires'.\n", v)
+				os.Exit(1)
+			}
+		}
+
+		_, authkey, err := u.AddKey(name[0], expires)
+		if err != nil {
+			fmt.Printf("Unable to add key: %s\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("Key '%s' with authkey '%s' added to user with id '%d' successfully.\n", name[0], authkey, u.Id)
+	},
+}
+
+var userKeyRevokeCmd = &cobra.Command{
+	Use:   "revoke <id> <name|prefix>",
+	Short: "Revokes authkey issued to user",
+	Run: func(cmd *cobra.Command, args []string) {
+		u, name := userArgs(cmd, args, 2)
+		if err := u.RevokeKey(name[0]); err != nil {
+			fmt.Printf("Unable to revoke key: %s\n", err)
+			os.Exit(1)
+		}
+
+		notify()
+		fmt.Printf("Key '%s' revoked from user with id '%d' successfully.\n", name[0], u.Id)
+	},
+}
+
+var userKeyListCmd = &cobra.Command{
+	Use:   "list <id>",
+	Short: "Lists authkeys issued to user",
+	Run: func(cmd *cobra.Command, args []string) {
+		u, _ := userArgs(cmd, args, 1)
+		keys, err := u.Keys()
+		if err != nil {
+			fmt.Printf("Unable to list keys: %s\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Println("Name\tPrefix\tCreated\tExpires\tLast used")
+		for _, k := range keys {
+			fmt.Printf("%s\t%s\t%s\t%s\t%s\n", k.Name, k.Prefix, formatTime(k.Created), formatTime(k.Expires), formatTime(k.LastUsed))
+		}
+	},
+}
+
+// Format time in 't', or return 'never' for zero times.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+
+	return t.Format(time.RFC3339)
+}
+
+var userConfigCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Manages configuration for modules set for single users",
+	Long: `Manages configuration for modules set for single users, as used by modules
+called by each user (e.g. the database connected to by the 'Database' module).
+Options are named by module, section and option, separated by dots (e.g.
+'database.database.name'), where sections may themselves contain dots (e.g.
+'limits.Database.Get.rate'). Options are printed as a table, or as JSON if
+'--json' is given, in the form accepted by 'User.SetOption'.`,
+}
+
+var userConfigGetCmd = &cobra.Command{
+	Use:   "get <id> <module.section.option>",
+	Short: "Prints option set for user",
+	Run: func(cmd *cobra.Command, args []string) {
+		u, path := userArgs(cmd, args, 2)
+
+		opts, err := userOptions(u, path[0])
+		if err != nil {
+			fmt.Printf("Unable to get option: %s\n", err)
+			os.Exit(1)
+		}
+
+		// Only an exact match is printed, and not options in a section or module
+		// named by the path given.
+		for _, o := range opts {
+			if o.path() == path[0] {
+				printOptions(cmd, []userOption{o})
+				return
+			}
+		}
+
+		fmt.Printf("Option '%s' is not set for user with id '%d'.\n", path[0], u.Id)
+		os.Exit(1)
+	},
+}
+
+var userConfigSetCmd = &cobra.Command{
+	Use:   "set <id> <module.section.option> <value>",
+	Short: "Sets option for user",
+	Run: func(cmd *cobra.Command, args []string) {
+		u, rest := userArgs(cmd, args, 3)
+
+		parts := strings.Split(rest[0], ".")
+		if len(parts) < 3 || parts[0] == "" || parts[len(parts)-1] == "" {
+			fmt.Printf("Invalid option '%s', expecting 'module.section.option'.\n", rest[0])
+			os.Exit(1)
+		}
+
+		module, section, option := parts[0], strings.Join(parts[1:len(parts)-1], "."), parts[len(parts)-1]
+		if _, err := u.SetOption(module, section, option, strings.Join(rest[1:], " ")); err != nil {
+			fmt.Printf("Unable to set option: %s\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("Option '%s' set for user with id '%d' successfully.\n", rest[0], u.Id)
+	},
+}
+
+var userConfigUnsetCmd = &cobra.Command{
+	Use:   "unset <id> <module[.section[.option]]>",
+	Short: "Removes option, or all options in section or module, for user",
+	Run: func(cmd *cobra.Command, args []string) {
+		u, path := userArgs(cmd, args, 2)
+
+		opts, err := userOptions(u, path[0])
+		if err != nil {
+			fmt.Printf("Unable to unset option: %s\n", err)
+			os.Exit(1)
+		} else if len(opts) == 0 {
+			fmt.Printf("Option '%s' is not set for user with id '%d'.\n", path[0], u.Id)
+			os.Exit(1)
+		}
+
+		for _, o := range opts {
+			if _, err = u.DeleteOption(o.module, o.section, o.option); err != nil {
+				fmt.Printf("Unable to unset option: %s\n", err)
+				os.Exit(1)
+			}
+		}
+
+		fmt.Printf("Options under '%s' removed from user with id '%d' successfully.\n", path[0], u.Id)
+	},
+}
+
+var userConfigShowCmd = &cobra.Command{
+	Use:   "show <id> [module[.section]]",
+	Short: "Prints all options, or options in section or module, set for user",
+	Run: func(cmd *cobra.Command, args []string) {
+		u, path := userArgs(cmd, args, 1)
+
+		var prefix string
+		if len(path) > 0 {
+			prefix = path[0]
+		}
+
+		opts, err := userOptions(u, prefix)
+		if err != nil {
+			fmt.Printf("Unable to show options: %s\n", err)
+			os.Exit(1)
+		}
+
+		printOptions(cmd, opts)
+	},
+}
+
+// An option set in a user's configuration.
+type userOption struct {
+	module, section, option, value string
+}
+
+// Return the dot-separated path naming option.
+func (o userOption) path() string {
+	return o.module + "." + o.section + "." + o.option
+}
+
+// Return options set for user 'u' named by, or under the module or section
+// named by, the dot-separated path in 'prefix', or all options if empty, in
+// order of path.
+func userOptions(u *user.User, prefix string) ([]userOption, error) {
+	modules, err := u.Modules()
+	if err != nil {
+		return nil, err
+	}
+
+	var opts []userOption
+	for _, module := range modules {
+		conf, err := u.Conf(module)
+		if err != nil {
+			return nil, err
+		}
+
+		for section, options := range *conf {
+			for option := range options {
+				o := userOption{module, section, option, conf.S(section, option)}
+				if p := o.path(); prefix == "" || p == prefix || strings.HasPrefix(p, prefix+".") {
+					opts = append(opts, o)
+				}
+			}
+		}
+	}
+
+	sort.Slice(opts, func(i, j int) bool {
+		return opts[i].path() < opts[j].path()
+	})
+
+	return opts, nil
+}
+
+// Print options in 'opts' as a table or, if requested for 'cmd', as JSON
+// objects nested by module, section and option.
+func printOptions(cmd *cobra.Command, opts []userOption) {
+	if asJSON, _ := cmd.Flags().GetBool("json"); asJSON {
+		data := make(map[string]map[string]map[string]string)
+		for _, o := range opts {
+			if _, exists := data[o.module]; !exists {
+				data[o.module] = make(map[string]map[string]string)
+			}
+
+			if _, exists := data[o.module][o.section]; !exists {
+				data[o.module][o.section] = make(map[string]string)
+			}
+
+			data[o.module][o.section][o.option] = o.value
+		}
+
+		out, _ := json.MarshalIndent(data, "", "  ")
+		fmt.Println(string(out))
+		return
+	}
+
+	fmt.Println("Module\tSection\tOption\tValue")
+	for _, o := range opts {
+		fmt.Printf("%s\t%s\t%s\t%s\n", o.module, o.section, o.option, o.value)
+	}
+}
+
+var userExportCmd = &cobra.Command{
+	Use:   "export [id]...",
+	Short: "Exports users and their configuration as JSON",
+	Long: `Exports users, or all users if no ids are given, along with their keys,
+permissions, certificate subjects and configuration, as a JSON document to be
+read by 'sleepyd user import'. Files kept for each user, as uploaded via the
+'File' and 'Image' modules or cached by the 'Template' module, are included if
+'--files' is given. Authkeys cannot be recovered from exports, and keys used
+for signing requests are exported encrypted with the secret key, so that only
+instances using the same secret key can import them.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		datadir := dataDir()
+
+		var ids []int
+		for _, arg := range args {
+			id, err := strconv.Atoi(arg)
+			if err != nil {
+				fmt.Printf("Invalid user id '%s'.\n", arg)
+				os.Exit(1)
+			}
+
+			ids = append(ids, id)
+		}
+
+		files, _ := cmd.Flags().GetBool("files")
+		archive, err := user.Export(datadir, files, ids...)
+		if err != nil {
+			fmt.Printf("Unable to export users: %s\n", err)
+			os.Exit(1)
+		}
+
+		out := os.Stdout
+		if name, _ := cmd.Flags().GetString("output"); name != "" && name != "-" {
+			if out, err = os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600); err != nil {
+				fmt.Printf("Unable to export users: %s\n", err)
+				os.Exit(1)
+			}
+
+			defer out.Close()
+		}
+
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		if err = enc.Encode(archive); err != nil {
+			fmt.Printf("Unable to export users: %s\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+var userImportCmd = &cobra.Command{
+	Use:   "import <file>",
+	Short: "Imports users exported by 'sleepyd user export'",
+	Long: `Imports users exported by 'sleepyd user export', read from the file given, or
+from standard input if '-'. Users whose ids are already in use are handled as
+set in '--on-conflict', either 'fail', failing the import, 'skip', skipping the
+user, 'replace', removing the existing user first, or 'renumber', importing the
+user under a new id. All users are checked before any user is imported, so that
+conflicts leave existing users untouched. Files included in the export replace
+any files kept for each user.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		datadir := dataDir()
+
+		in := os.Stdin
+		if args[0] != "-" {
+			f, err := os.Open(args[0])
+			if err != nil {
+				fmt.Printf("Unable to import users: %s\n", err)
+				os.Exit(1)
+			}
+
+			defer f.Close()
+			in = f
+		}
+
+		var archive user.Archive
+		if err := json.NewDecoder(in).Decode(&archive); err != nil {
+			fmt.Printf("Unable to import users: file is not a valid export: %s\n", err)
+			os.Exit(1)
+		}
+
+		conflict, _ := cmd.Flags().GetString("on-conflict")
+		imported, err := user.Import(&archive, datadir, conflict)
+		for _, u := range archive.Users {
+			if id, exists := imported[u.Id]; !exists {
+				continue
+			} else if id != u.Id {
+				fmt.Printf("User with id '%d' imported with id '%d'.\n", u.Id, id)
+			} else {
+				fmt.Printf("User with id '%d' imported.\n", u.Id)
+			}
+		}
+
+		if len(imported) > 0 {
+			notify()
+		}
+
+		if err != nil {
+			fmt.Printf("Unable to import users: %s\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("%d of %d users imported successfully.\n", len(imported), len(archive.Users))
+	},
+}
+
+// Set up local environment and return the data directory, exiting on any error.
+func dataDir() string {
+	if _, err := setup(flags.config, false); err != nil {
+		fmt.Printf("Unable to initialize environment: %s\n", err)
+		os.Exit(1)
+	}
+
+	c, err := config.Load(flags.config)
+	if err != nil {
+		fmt.Printf("Unable to read file '%s'.\n", flags.config)
+		os.Exit(1)
+	}
+
+	return c.S("directories", "data")
+}
+
+// Signal the server running locally, if any, to empty its cache of keys and the
+// users they were issued to, so that changes made to users take effect at once.
+// Servers on other hosts sharing the user store pick up changes once keys
+// expire from their cache.
+func notify() {
+	c, err := config.Load(flags.config)
+	if err != nil {
+		return
+	}
+
+	data, err := ioutil.ReadFile(c.S("directories", "tmp") + "/sleepy.pid")
+	if err != nil {
+		return
+	}
+
+	if pid, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil && pid > 0 && isServer(pid) {
+		syscall.Kill(pid, syscall.SIGUSR1)
+	}
+}
+
+// Check that process with 'pid' runs the same executable as this process. The
+// PID file is left in place if the server does not shut down cleanly, and its
+// PID may since have been taken by an unrelated process, which would be killed
+// by the signal sent. Processes are only checked where '/proc' is available,
+// and are otherwise never signalled.
+func isServer(pid int) bool {
+	self, err := os.Executable()
+	if err != nil {
+		return false
+	}
+
+	exe, err := os.Readlink("/proc/" + strconv.Itoa(pid) + "/exe")
+	if err != nil {
+		return false
+	}
+
+	// Executables replaced while running, e.g. on upgrade, are reported with a
+	// suffix marking them as deleted.
+	exe = strings.TrimSuffix(exe, " (deleted)")
+	if self, err = filepath.EvalSymlinks(self); err != nil {
+		return false
+	}
+
+	return exe == self
+}
+
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Prints calls to module methods recorded in the audit log",
+	Long: `Prints calls to module methods recorded in the audit log, most recent first.
+Times passed to '--since' and '--until' are either in RFC 3339 format (e.g.
+'2014-06-01T12:00:00Z'), dates (e.g. '2014-06-01') or durations relative to
+the current time (e.g. '24h').`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if _, err := setup(flags.config, false); err != nil {
+			fmt.Printf("Unable to initialize environment: %s\n", err)
+			os.Exit(1)
+		}
+
+		var f audit.Filter
+		var err error
+
+		f.User, _ = cmd.Flags().GetInt("user")
+		f.Module, _ = cmd.Flags().GetString("module")
+		f.Method, _ = cmd.Flags().GetString("method")
+		f.Limit, _ = cmd.Flags().GetInt("limit")
+
+		for name, t := range map[string]*time.Time{"since": &f.Since, "until": &f.Until} {
+			if v, _ := cmd.Flags().GetString(name); v != "" {
+				if *t, err = parseTime(v); err != nil {
+					fmt.Printf("Invalid time '%s' for '--%s'.\n", v, name)
+					os.Exit(1)
+				}
+			}
+		}
+
+		entries, err := audit.Query(f)
+		if err != nil {
+			fmt.Printf("Unable to query audit log: %s\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Println("Time\tUser\tMethod\tDuration\tOutcome\tParameters")
+		for _, e := range entries {
+			outcome := "OK"
+			if e.Code != 0 {
+				outcome = fmt.Sprintf("Error %d: %s", e.Code, e.Error)
+			}
+
+			fmt.Printf("%s\t%d\t%s.%s\t%s\t%s\t%s\n", e.Time.Format(time.RFC3339), e.User, e.Module, e.Method,
+				e.Duration, outcome, e.Params)
+		}
+	},
+}
+
+// Parse time in 's', given in RFC 3339 format, as a date or as a duration
+// relative to the current time.
+func parseTime(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+
+	return time.Parse(time.RFC3339, s)
+}
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Upgrades the user store schema to the latest version",
+	Long: `Upgrades the user store schema to the latest version, creating the system
+database if it does not exist. The schema is upgraded on startup unless the
+'auto-migrate' option is disabled, in which case this is to be run before
+starting a new version of Sleepy.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		c, err := config.Load(flags.config)
+		if err != nil {
+			fmt.Printf("Unable to read file '%s'.\n", flags.config)
+			os.Exit(1)
+		}
+
+		if err = user.Setup(c.S("directories", "data"), c.S("sqlite", "filename"), c); err != nil {
+			fmt.Printf("Unable to initialize environment: %s\n", err)
+			os.Exit(1)
+		}
+
+		from, to, err := user.Migrate()
+		if err != nil {
+			fmt.Printf("Unable to upgrade database schema: %s\n", err)
+			os.Exit(1)
+		}
+
+		if from == to {
+			fmt.Printf("Database schema is up to date, at version %d.\n", to)
+		} else {
+			fmt.Printf("Database schema upgraded from version %d to %d successfully.\n", from, to)
+		}
+	},
+}
+
+var describeCmd = &cobra.Command{
+	Use:   "describe",
+	Short: "Prints a description of all module methods as JSON Schema",
+	Run: func(cmd *cobra.Command, args []string) {
+		buf, err := json.MarshalIndent(server.Describe(), "", "  ")
+		if err != nil {
+			fmt.Printf("Unable to describe modules: %s\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Println(string(buf))
+	},
+}
+
 var versionCmd = &cobra.Command{
 	Use:   "version",
 	Short: "Prints the program name and version number",
@@ -124,25 +935,30 @@ func setup(conf string, remote bool) (net.Listener, error) {
 		}
 	}
 
-	// Connect to system database.
+	// Connect to user store.
 	datadir := c.S("directories", "data")
-	err = user.Setup(datadir, c.S("sqlite", "filename"))
+	err = user.Setup(datadir, c.S("sqlite", "filename"), c)
 	if err != nil {
 		return nil, err
 	}
 
-	// Write our PID to a file.
-	ioutil.WriteFile(tmpdir+"/sleepy.pid", []byte(strconv.Itoa(os.Getpid())), 0644)
-
-	// Handle SIGINT and SIGTERM signals.
-	go func() {
-		sigchan := make(chan os.Signal, 1)
-		signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
-		<-sigchan
+	// Bring user store schema up to date, unless disabled, in which case the
+	// schema is upgraded by running 'sleepyd migrate'.
+	if auto, err := c.Bool("users", "auto-migrate"); err != nil || auto {
+		if _, _, err = user.Migrate(); err != nil {
+			return nil, err
+		}
+	} else if current, latest, err := user.SchemaVersion(); err != nil {
+		return nil, err
+	} else if current < latest {
+		return nil, fmt.Errorf("Database schema version %d is out of date, please run 'sleepyd migrate' to upgrade to version %d", current, latest)
+	}
 
-		log.Println("Shutting down Sleepy...")
-		os.Exit(0)
-	}()
+	// Set up audit log, stored in the system database.
+	err = audit.Setup(datadir, c.S("sqlite", "filename"), c)
+	if err != nil {
+		return nil, err
+	}
 
 	// Initialize networking parts if not running a local operation.
 	if remote == true {
@@ -152,38 +968,193 @@ func setup(conf string, remote bool) (net.Listener, error) {
 			return nil, err
 		}
 
-		// Set up TCP socket.
-		ln, err := net.Listen("tcp", c.S("sleepy", "address")+":"+c.S("sleepy", "port"))
+		// Set up TCP socket, serving over TLS if enabled.
+		ln, err := listen(c, "rpc", address(c.S("sleepy", "address"), c.S("sleepy", "port")))
 		if err != nil {
 			return nil, err
 		}
 
-		// Register the RPC method receiver for external method calls.
-		rpc.RegisterName("Sleepy", &server.Server{})
+		tlsconf, err := server.TLSConfig(c)
+		if err != nil {
+			return nil, err
+		} else if tlsconf != nil {
+			ln = tls.NewListener(ln, tlsconf)
+		}
+
+		// Set up sockets for embedded HTTP and FTP servers.
+		httpln, err := listen(c, "http", address(c.S("http", "listen"), c.S("http", "port")))
+		if err != nil {
+			return nil, err
+		}
+
+		ftpln, err := listen(c, "ftp", address(c.S("ftp", "address"), c.S("ftp", "port")))
+		if err != nil {
+			return nil, err
+		}
 
 		// Start embedded HTTP server.
-		go func() {
-			http.Handle("/", server.HTTPHandler(datadir+"/serve/"))
-			http.ListenAndServe(":"+c.S("http", "port"), nil)
-		}()
+		mux := http.NewServeMux()
+		mux.Handle("/", server.HTTPHandler(datadir+"/serve/"))
+
+		// Serve RPC calls over HTTP, unless disabled by setting an empty path.
+		rpcpath, err := c.String("http", "rpc-path")
+		if err != nil {
+			rpcpath = "/rpc"
+		}
+
+		if rpcpath != "" {
+			maxbody, err := c.Int("http", "rpc-max-body")
+			if err != nil {
+				maxbody = 1048576
+			}
+
+			mux.Handle(rpcpath, server.RPCHandler(maxbody))
+		}
+
+		keepalive, err := c.Int("http", "keep-alive")
+		if err != nil {
+			keepalive = 60
+		}
+
+		state.http = &http.Server{
+			Handler:     mux,
+			IdleTimeout: time.Duration(keepalive) * time.Second,
+		}
+
+		state.http.SetKeepAlivesEnabled(keepalive > 0)
+		go state.http.Serve(httpln)
 
 		// Start embedded FTP server.
-		go func() {
-			server.ServeFTP(c.S("ftp", "address") + ":" + c.S("ftp", "port"))
-		}()
+		go server.ServeFTP(ftpln)
+
+		// Serve metrics on a separate socket, unless disabled.
+		addr, err := c.String("metrics", "address")
+		if err != nil {
+			addr = "127.0.0.1"
+		}
+
+		if addr != "" {
+			port, err := c.String("metrics", "port")
+			if err != nil {
+				port = "6009"
+			}
+
+			metricsln, err := listen(c, "metrics", address(addr, port))
+			if err != nil {
+				return nil, err
+			}
+
+			path, err := c.String("metrics", "path")
+			if err != nil || path == "" {
+				path = "/metrics"
+			}
+
+			mux := http.NewServeMux()
+			mux.Handle(path, metrics.Handler())
+
+			state.metrics = &http.Server{Handler: mux}
+			go state.metrics.Serve(metricsln)
+		}
 
 		// Get limit for maximum concurrent connections to server.
 		if flags.connections == 0 {
 			flags.connections = c.I("sleepy", "max-connections")
 		}
 
+		state.queue = make(chan bool, flags.connections)
+		metrics.NewGaugeFunc("sleepy_connections", "RPC connections currently being served, out of 'max-connections'.", func() float64 {
+			return float64(len(state.queue))
+		})
+
+		metrics.NewGaugeFunc("sleepy_connections_max", "Maximum number of concurrent RPC connections.", func() float64 {
+			return float64(flags.connections)
+		})
+
+		// Get time to wait for in-flight requests when shutting down.
+		state.timeout = shutdownTimeout(c)
+
+		// Write our PID to a file, replacing the PID of any process we are
+		// taking over from.
+		state.pidfile = tmpdir + "/sleepy.pid"
+		ioutil.WriteFile(state.pidfile, []byte(strconv.Itoa(os.Getpid())), 0644)
+
+		// Signal parent process to shut down, if we have taken over from one.
+		if err = server.Ready(); err != nil {
+			log.Println(err)
+		}
+
 		return ln, nil
 	}
 
 	return nil, nil
 }
 
+// Return listening address for 'host' and 'port', or 'host' alone if it refers
+// to a Unix domain socket.
+func address(host, port string) string {
+	if strings.HasPrefix(host, "unix:") {
+		return host
+	}
+
+	return net.JoinHostPort(host, port)
+}
+
+// Open listener 'name' on 'addr', applying the permissions and ownership set
+// in 'c' to Unix domain sockets.
+func listen(c *config.Config, name, addr string) (net.Listener, error) {
+	ln, err := server.Listen(name, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Listeners passed by systemd may differ from the address configured.
+	if ln.Addr().Network() != "unix" {
+		return ln, nil
+	}
+
+	path := ln.Addr().String()
+
+	mode, err := strconv.ParseUint(c.S("sleepy", "socket-mode"), 8, 32)
+	if err != nil {
+		mode = 0660
+	}
+
+	if err = os.Chmod(path, os.FileMode(mode)); err != nil {
+		return nil, err
+	}
+
+	uid, gid := -1, -1
+	if owner := c.S("sleepy", "socket-owner"); owner != "" {
+		u, err := osuser.Lookup(owner)
+		if err != nil {
+			return nil, err
+		}
+
+		uid, _ = strconv.Atoi(u.Uid)
+	}
+
+	if group := c.S("sleepy", "socket-group"); group != "" {
+		g, err := osuser.LookupGroup(group)
+		if err != nil {
+			return nil, err
+		}
+
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+
+	if err = os.Chown(path, uid, gid); err != nil {
+		return nil, err
+	}
+
+	return ln, nil
+}
+
 func run() {
+	// Handle signals for reloading, restarting and shutting down, which may be
+	// sent as soon as we are ready to accept connections.
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2)
+
 	// Setup core environment.
 	ln, err := setup(flags.config, true)
 	if err != nil {
@@ -191,35 +1162,209 @@ func run() {
 		os.Exit(1)
 	}
 
-	defer ln.Close()
-
 	// Start serving connections.
 	log.Println("Staring Sleepy...")
-	queue := make(chan bool, flags.connections)
+	go serve(ln)
+
+	for sig := range sigchan {
+		if sig == syscall.SIGHUP {
+			log.Println("Reloading configuration...")
+			reload()
+			continue
+		} else if sig == syscall.SIGUSR1 {
+			reloadUsers()
+			continue
+		} else if sig == syscall.SIGUSR2 {
+			log.Println("Restarting Sleepy...")
+			restart()
+			continue
+		}
+
+		break
+	}
+
+	shutdown()
+}
+
+// Re-read main and module configuration files and apply changes to running
+// modules. The current configuration is kept if any file fails to load.
+func reload() {
+	c, err := config.Load(flags.config)
+	if err != nil {
+		log.Printf("Unable to reload configuration file '%s': %s", flags.config, err)
+		return
+	}
+
+	if err = server.Reload(c); err != nil {
+		log.Printf("Unable to reload configuration: %s", err)
+		return
+	}
+
+	user.Reload(c)
+
+	state.timeout = shutdownTimeout(c)
+}
+
+// Empty cache of keys and the users they were issued to, as signalled by the
+// command line after making changes to users.
+func reloadUsers() {
+	c, err := config.Load(flags.config)
+	if err != nil {
+		log.Printf("Unable to reload configuration file '%s': %s", flags.config, err)
+		return
+	}
+
+	user.Reload(c)
+}
+
+// Return time to wait for in-flight requests when shutting down.
+func shutdownTimeout(c *config.Config) time.Duration {
+	timeout, err := c.Int("sleepy", "shutdown-timeout")
+	if err != nil {
+		timeout = 30
+	}
+
+	return time.Duration(timeout) * time.Second
+}
+
+// Accept connections on listener 'ln' until the listener is closed.
+func serve(ln net.Listener) {
+	queue := state.queue
 
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
 			log.Printf("Failed to handle connection: %s", err)
 			continue
 		}
 
 		queue <- true
 		go func(conn net.Conn) {
-			jsonrpc.ServeConn(conn)
+			server.ServeConn(conn)
 			<-queue
 		}(conn)
 	}
 }
 
+// Start new server process, handing over all listening sockets. The new process
+// signals us to shut down once it is ready to accept connections.
+func restart() {
+	p, err := server.Handover()
+	if err != nil {
+		log.Printf("Unable to restart: %s", err)
+		return
+	}
+
+	go func() {
+		if s, err := p.Wait(); err == nil && !s.Success() {
+			log.Printf("Unable to restart: new process exited with '%s'", s)
+		}
+	}()
+}
+
+// Stop accepting connections and wait for in-flight requests to complete, up
+// to the configured timeout, before shutting down modules and exiting.
+func shutdown() {
+	log.Println("Shutting down Sleepy...")
+
+	ctx, cancel := context.WithTimeout(context.Background(), state.timeout)
+	defer cancel()
+
+	// Drain HTTP connections alongside RPC and FTP connections.
+	done := make(chan error, 1)
+	go func() {
+		done <- state.http.Shutdown(ctx)
+	}()
+
+	if err := server.Stop(ctx); err != nil {
+		log.Println(err)
+	}
+
+	if err := <-done; err != nil {
+		log.Printf("Timed out waiting for HTTP requests to finish: %s", err)
+	}
+
+	if state.metrics != nil {
+		state.metrics.Close()
+	}
+
+	if err := server.Shutdown(); err != nil {
+		log.Println(err)
+	}
+
+	// Write any audit log entries left before closing the system database.
+	audit.Close()
+	user.Close()
+
+	// Remove PID file, unless it has been taken over by a new process.
+	if pid, err := ioutil.ReadFile(state.pidfile); err == nil && string(pid) == strconv.Itoa(os.Getpid()) {
+		os.Remove(state.pidfile)
+	}
+
+	os.Exit(0)
+}
+
 func main() {
 	rootCmd.PersistentFlags().StringVarP(&flags.config, "config", "c", "/etc/sleepy/sleepy.conf", "Main configuration file to read from")
 	rootCmd.PersistentFlags().Int64VarP(&flags.connections, "max-connections", "m", 0, "Max concurrent connections to server")
 	userCmd.Flags().BoolP("add", "a", true, "Add user to server")
 	userCmd.Flags().IntP("remove", "r", 0, "Remove user from server")
 	userCmd.Flags().BoolP("list", "l", true, "List users on server")
+	userCmd.Flags().String("name", "", "Name of user added, or text names of users listed contain")
+	userCmd.Flags().String("email", "", "Email address of user added, or text addresses of users listed contain")
+	userCmd.Flags().String("label", "", "Comma-separated labels of user added, or label of users listed")
+	userCmd.Flags().String("status", "", "Status of users listed, either 'enabled' or 'suspended'")
+
+	userCmd.AddCommand(userShowCmd)
+	userCmd.AddCommand(userUpdateCmd)
+	userCmd.AddCommand(userSuspendCmd)
+	userCmd.AddCommand(userEnableCmd)
+	userCmd.AddCommand(userGrantCmd)
+	userCmd.AddCommand(userRevokeCmd)
+	userCmd.AddCommand(userCertCmd)
+	userCmd.AddCommand(userKeyCmd)
+	userCmd.AddCommand(userConfigCmd)
+	userCmd.AddCommand(userExportCmd)
+	userCmd.AddCommand(userImportCmd)
+
+	userCertCmd.AddCommand(userCertAddCmd)
+	userCertCmd.AddCommand(userCertRemoveCmd)
+	userCertCmd.AddCommand(userCertListCmd)
+
+	userKeyCmd.AddCommand(userKeyAddCmd)
+	userKeyCmd.AddCommand(userKeyRevokeCmd)
+	userKeyCmd.AddCommand(userKeyListCmd)
+	userKeyAddCmd.Flags().String("expires", "", "Time after which the key expires, or never if unset")
+
+	userConfigCmd.AddCommand(userConfigGetCmd)
+	userConfigCmd.AddCommand(userConfigSetCmd)
+	userConfigCmd.AddCommand(userConfigUnsetCmd)
+	userConfigCmd.AddCommand(userConfigShowCmd)
+	userConfigCmd.PersistentFlags().Bool("json", false, "Print options as JSON")
+
+	userExportCmd.Flags().StringP("output", "o", "", "File to write export to, or standard output if unset")
+	userExportCmd.Flags().Bool("files", false, "Include files kept for users")
+	userImportCmd.Flags().String("on-conflict", user.ConflictFail, "Handling of users with ids in use, either 'fail', 'skip', 'replace' or 'renumber'")
+
+	userUpdateCmd.Flags().String("name", "", "Name of user")
+	userUpdateCmd.Flags().String("email", "", "Email address of user")
+	userUpdateCmd.Flags().String("labels", "", "Comma-separated labels of user")
+
+	auditCmd.Flags().IntP("user", "u", 0, "Show calls made by user with id")
+	auditCmd.Flags().String("module", "", "Show calls to module")
+	auditCmd.Flags().String("method", "", "Show calls to method, in combination with '--module'")
+	auditCmd.Flags().String("since", "", "Show calls made at or after time")
+	auditCmd.Flags().String("until", "", "Show calls made at or before time")
+	auditCmd.Flags().IntP("limit", "n", 100, "Show at most this many calls, or all calls if '0'")
 
 	rootCmd.AddCommand(userCmd)
+	rootCmd.AddCommand(auditCmd)
+	rootCmd.AddCommand(migrateCmd)
+	rootCmd.AddCommand(describeCmd)
 	rootCmd.AddCommand(versionCmd)
 	rootCmd.Execute()
 }
@@ -7,7 +7,10 @@
 package auth
 
 import (
+	"errors"
+
 	"code.google.com/p/go.crypto/bcrypt"
+	"github.com/deuill/sleepy/core/config"
 	"github.com/deuill/sleepy/core/server"
 )
 
@@ -17,7 +20,7 @@ func (a *Auth) GeneratePassword(passwd string) (string, error) {
 	// Hash password with bcrypt.
 	hash, err := bcrypt.GenerateFromPassword([]byte(passwd), bcrypt.DefaultCost)
 	if err != nil {
-		return "", nil
+		return "", server.Errorf(server.InvalidParams, "Unable to generate password hash: %s", err)
 	}
 
 	return string(hash), nil
@@ -25,13 +28,27 @@ func (a *Auth) GeneratePassword(passwd string) (string, error) {
 
 func (a *Auth) ValidatePassword(passwd, hash string) (bool, error) {
 	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(passwd))
-	if err != nil {
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
 		return false, nil
+	} else if err != nil {
+		return false, server.Errorf(server.InvalidParams, "Password hash is malformed: %s", err)
 	}
 
 	return true, nil
 }
 
+func (a *Auth) Setup(config *config.Config) error {
+	return nil
+}
+
+func (a *Auth) Shutdown() error {
+	return nil
+}
+
+func (a *Auth) Health() error {
+	return nil
+}
+
 func init() {
 	server.Register(&Auth{})
 }
@@ -7,10 +7,11 @@ package database
 import (
 	"database/sql"
 	"encoding/json"
-	"fmt"
 	"sync"
 
 	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/deuill/sleepy/core/metrics"
+	"github.com/deuill/sleepy/core/server"
 )
 
 var metaCache struct {
@@ -20,15 +21,31 @@ var metaCache struct {
 
 var dataCache *memcache.Client
 
+// Servers used by 'dataCache', which may be changed while running.
+var cacheServers memcache.ServerList
+
+// Lookups in 'dataCache', by result, which is one of 'hit', 'miss' or 'error'.
+var cacheLookups = metrics.NewCounter("sleepy_database_cache_lookups_total",
+	"Lookups in the query result cache, by result.", "result")
+
 // Check cache for request with signature 'sig' and return data if cached entity exists.
 func getCache(sig string) []map[string]interface{} {
-	if item, error := dataCache.Get("sleepy/database/" + sig); error == nil {
+	item, error := dataCache.Get("sleepy/database/" + sig)
+	if error == nil {
+		cacheLookups.Inc("hit")
+
 		var data []map[string]interface{}
 		json.Unmarshal(item.Value, &data)
 
 		return data
 	}
 
+	if error == memcache.ErrCacheMiss {
+		cacheLookups.Inc("miss")
+	} else {
+		cacheLookups.Inc("error")
+	}
+
 	return nil
 }
 
@@ -77,7 +94,7 @@ func getMetaCache(db *sql.DB, database, table string) error {
 
 		dbs, error := db.Query("SHOW DATABASES WHERE `Database` != 'information_schema' AND `Database` != 'performance_schema'")
 		if error != nil {
-			return fmt.Errorf("Error executing query: %s", error)
+			return queryError(error)
 		}
 
 		for dbs.Next() {
@@ -88,7 +105,7 @@ func getMetaCache(db *sql.DB, database, table string) error {
 		}
 	} else {
 		if _, exists := metaCache.data[database]; !exists {
-			return fmt.Errorf("Invalid database name specified: '%s'", database)
+			return server.Errorf(server.NotFound, "Invalid database name specified: '%s'", database)
 		}
 
 		databases = append(databases, database)
@@ -102,7 +119,7 @@ func getMetaCache(db *sql.DB, database, table string) error {
 
 			tbls, error := db.Query("SELECT TABLE_NAME FROM information_schema.TABLES WHERE TABLE_SCHEMA = ?", dt)
 			if error != nil {
-				return fmt.Errorf("Error executing query: %s", error)
+				return queryError(error)
 			}
 
 			for tbls.Next() {
@@ -113,7 +130,7 @@ func getMetaCache(db *sql.DB, database, table string) error {
 			}
 		} else {
 			if _, exists := metaCache.data[dt][table]; !exists {
-				return fmt.Errorf("Invalid table name specified: '%s.%s'", dt, table)
+				return server.Errorf(server.NotFound, "Invalid table name specified: '%s.%s'", dt, table)
 			}
 
 			tables = append(tables, table)
@@ -126,7 +143,7 @@ func getMetaCache(db *sql.DB, database, table string) error {
 
 			cols, error := db.Query("SELECT COLUMN_NAME FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ?", dt, tt)
 			if error != nil {
-				return fmt.Errorf("Error executing query: %s", error)
+				return queryError(error)
 			}
 
 			for cols.Next() {
@@ -142,15 +159,15 @@ func getMetaCache(db *sql.DB, database, table string) error {
 func checkMeta(database, table, column string) error {
 	if database != "" && table == "" && column == "" {
 		if _, exists := metaCache.data[database]; !exists {
-			return fmt.Errorf("Invalid database name specified: '%s'", database)
+			return server.Errorf(server.NotFound, "Invalid database name specified: '%s'", database)
 		}
 	} else if database != "" && table != "" && column == "" {
 		if _, exists := metaCache.data[database][table]; !exists {
-			return fmt.Errorf("Invalid table name specified: '%s.%s'", database, table)
+			return server.Errorf(server.NotFound, "Invalid table name specified: '%s.%s'", database, table)
 		}
 	} else if database != "" && table != "" && column != "" {
 		if _, exists := metaCache.data[database][table][column]; !exists {
-			return fmt.Errorf("Invalid column name specified: '%s.%s.%s'", database, table, column)
+			return server.Errorf(server.NotFound, "Invalid column name specified: '%s.%s.%s'", database, table, column)
 		}
 	}
 
@@ -7,15 +7,21 @@
 package database
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
+	"net"
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/bradfitz/gomemcache/memcache"
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 	"github.com/deuill/sleepy/core/config"
+	"github.com/deuill/sleepy/core/metrics"
 	"github.com/deuill/sleepy/core/server"
 	"github.com/deuill/sleepy/core/user"
 )
@@ -24,7 +30,8 @@ type Database struct {
 	// Contains private or unexported fields.
 	conf   *config.Config
 	conn   map[string]*sql.DB
-	client map[string]*config.Config
+	client map[int]*config.Config
+	mutex  sync.Mutex
 }
 
 type Request struct {
@@ -57,12 +64,12 @@ type OrderRequest struct {
 	Order  string
 }
 
-func (d *Database) Get(p Request) (interface{}, error) {
+func (d *Database) Get(ctx context.Context, p Request) (interface{}, error) {
 	if result := getCache(p.Sig); result != nil {
 		return result, nil
 	}
 
-	db, error := d.prepare(&p)
+	db, error := d.prepare(ctx, &p)
 	if error != nil {
 		return false, error
 	}
@@ -162,7 +169,7 @@ func (d *Database) Get(p Request) (interface{}, error) {
 	}
 
 	// Execute query and return results.
-	result, error := d.query(db, query, values)
+	result, error := d.query(ctx, db, query, values)
 	if error != nil {
 		return false, error
 	}
@@ -172,8 +179,8 @@ func (d *Database) Get(p Request) (interface{}, error) {
 	return result, nil
 }
 
-func (d *Database) Put(p Request) (interface{}, error) {
-	db, error := d.prepare(&p)
+func (d *Database) Put(ctx context.Context, p Request) (interface{}, error) {
+	db, error := d.prepare(ctx, &p)
 	if error != nil {
 		return false, error
 	}
@@ -224,7 +231,7 @@ func (d *Database) Put(p Request) (interface{}, error) {
 	}
 
 	// Execute query.
-	result, error := d.exec(db, query, values)
+	result, error := d.exec(ctx, db, query, values)
 	if error != nil {
 		return false, error
 	}
@@ -234,8 +241,8 @@ func (d *Database) Put(p Request) (interface{}, error) {
 	return result, nil
 }
 
-func (d *Database) Delete(p Request) (interface{}, error) {
-	db, error := d.prepare(&p)
+func (d *Database) Delete(ctx context.Context, p Request) (interface{}, error) {
+	db, error := d.prepare(ctx, &p)
 	if error != nil {
 		return false, error
 	}
@@ -256,11 +263,11 @@ func (d *Database) Delete(p Request) (interface{}, error) {
 		query += subquery
 		values = append(values, subvalues...)
 	} else {
-		return false, fmt.Errorf("No WHERE clause found")
+		return false, server.Errorf(server.InvalidParams, "No WHERE clause found")
 	}
 
 	// Execute query.
-	result, error := d.exec(db, query, values)
+	result, error := d.exec(ctx, db, query, values)
 	if error != nil {
 		return false, error
 	}
@@ -270,8 +277,12 @@ func (d *Database) Delete(p Request) (interface{}, error) {
 	return result, nil
 }
 
-func (d *Database) Query(p Request) (interface{}, error) {
-	db, error := d.prepare(&p)
+func (d *Database) Query(ctx context.Context, p Request) (interface{}, error) {
+	if strings.TrimSpace(p.Query) == "" {
+		return false, server.Errorf(server.InvalidParams, "Query is empty")
+	}
+
+	db, error := d.prepare(ctx, &p)
 	if error != nil {
 		return false, error
 	}
@@ -281,12 +292,12 @@ func (d *Database) Query(p Request) (interface{}, error) {
 
 	switch action {
 	case "SELECT":
-		result, error = d.query(db, p.Query, p.Parameters)
+		result, error = d.query(ctx, db, p.Query, p.Parameters)
 		if error != nil {
 			return false, error
 		}
 	default:
-		result, error = d.exec(db, p.Query, p.Parameters)
+		result, error = d.exec(ctx, db, p.Query, p.Parameters)
 		if error != nil {
 			return false, error
 		}
@@ -307,12 +318,13 @@ func (d *Database) Query(p Request) (interface{}, error) {
 }
 
 // Execute query string on db with optional params in place of positional
-// parameters. Returns results as rows of columns mapped to values.
-func (d *Database) query(db *sql.DB, query string, params []interface{}) ([]map[string]interface{}, error) {
+// parameters, cancelling the query when 'ctx' is done. Returns results as rows
+// of columns mapped to values.
+func (d *Database) query(ctx context.Context, db *sql.DB, query string, params []interface{}) ([]map[string]interface{}, error) {
 	// Execute query.
-	rows, error := db.Query(query, params...)
+	rows, error := db.QueryContext(ctx, query, params...)
 	if error != nil {
-		return nil, fmt.Errorf("Error executing query: %s", error)
+		return nil, queryError(error)
 	}
 
 	// Process query results
@@ -352,12 +364,13 @@ func (d *Database) query(db *sql.DB, query string, params []interface{}) ([]map[
 }
 
 // Execute query string on db with optional params in place of positional
-// parameters. Returns the last inserted ID in case of an INSERT query, and
-// the number of rows affected in any other query.
-func (d *Database) exec(db *sql.DB, query string, params []interface{}) (interface{}, error) {
-	summary, error := db.Exec(query, params...)
+// parameters, cancelling the query when 'ctx' is done. Returns the last inserted
+// ID in case of an INSERT query, and the number of rows affected in any other
+// query.
+func (d *Database) exec(ctx context.Context, db *sql.DB, query string, params []interface{}) (interface{}, error) {
+	summary, error := db.ExecContext(ctx, query, params...)
 	if error != nil {
-		return nil, fmt.Errorf("Error executing query: %s", error)
+		return nil, queryError(error)
 	}
 
 	var result interface{}
@@ -378,14 +391,53 @@ func (d *Database) exec(db *sql.DB, query string, params []interface{}) (interfa
 	return result, nil
 }
 
+// MySQL errors caused by transient conditions on the database server, such as
+// deadlocks or too many connections, rather than by the query itself.
+var transientErrors = map[uint16]bool{
+	1040: true, // Too many connections.
+	1053: true, // Server shutdown in progress.
+	1203: true, // User has exceeded maximum active connections.
+	1205: true, // Lock wait timeout exceeded.
+	1213: true, // Deadlock found when trying to get lock.
+}
+
+// Return error for failed query, distinguishing between errors in the query
+// itself, which carry the MySQL error number, and the database server being
+// unreachable or temporarily unable to run the query.
+func queryError(err error) error {
+	var e *mysql.MySQLError
+	var n net.Error
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return server.Errorf(server.Timeout, "Error executing query: %s", err)
+	case errors.As(err, &e):
+		code := server.InvalidParams
+		if transientErrors[e.Number] {
+			code = server.Unavailable
+		}
+
+		return server.Errorf(code, "Error executing query: %s", e.Message).WithData(map[string]interface{}{
+			"number": e.Number,
+		})
+	case errors.As(err, &n), errors.Is(err, driver.ErrBadConn), errors.Is(err, mysql.ErrInvalidConn):
+		return server.Errorf(server.Unavailable, "Error executing query: %s", err)
+	}
+
+	return fmt.Errorf("Error executing query: %w", err)
+}
+
 // Parse configuration, connect to database and validate data
-func (d *Database) prepare(p *Request) (*sql.DB, error) {
+func (d *Database) prepare(ctx context.Context, p *Request) (*sql.DB, error) {
 	var error error
 
-	// Load configuration for user.
-	u, error := user.Auth(p.Auth)
-	if error != nil {
-		return nil, error
+	// Load configuration for user, as authenticated by the authkey given or, if
+	// none is given, the user making the call.
+	u := server.Caller(ctx)
+	if p.Auth != "" || u == nil {
+		if u, error = user.Auth(p.Auth); error != nil {
+			return nil, server.Errorf(server.Unauthorized, "%s", error)
+		}
 	}
 
 	c, error := u.Conf("database")
@@ -393,19 +445,25 @@ func (d *Database) prepare(p *Request) (*sql.DB, error) {
 		return nil, error
 	}
 
-	d.client[p.Auth] = c
-	name, _ := d.client[p.Auth].String("database", "name")
+	name, _ := c.String("database", "name")
+
+	d.mutex.Lock()
+	d.client[u.Id] = c
 
 	// Connect to database, if no connection exists.
-	if _, exists := d.conn[name]; !exists {
-		db, error := d.connect(name)
+	db, exists := d.conn[name]
+	if !exists {
+		db, error = d.connect(name)
 		if error != nil {
+			d.mutex.Unlock()
 			return nil, error
 		}
 
 		d.conn[name] = db
 	}
 
+	d.mutex.Unlock()
+
 	// Extract database/table name from query.
 	if p.Query != "" {
 		split := strings.Fields(p.Query)
@@ -450,7 +508,7 @@ func (d *Database) prepare(p *Request) (*sql.DB, error) {
 			if stmt == "CREATE" && obj == "TABLE" {
 				s := strings.Split(split[pos+1], ".")
 				if len(s) > 2 || len(s) < 1 {
-					return nil, fmt.Errorf("Table name is malformed")
+					return nil, server.Errorf(server.InvalidParams, "Table name is malformed")
 				}
 
 				if len(split) == 2 {
@@ -480,7 +538,7 @@ func (d *Database) prepare(p *Request) (*sql.DB, error) {
 	if p.Table != "" {
 		split := strings.Split(p.Table, ".")
 		if len(split) > 2 || len(split) < 1 {
-			return nil, fmt.Errorf("Table name is malformed")
+			return nil, server.Errorf(server.InvalidParams, "Table name is malformed")
 		}
 
 		if len(split) == 2 {
@@ -501,7 +559,7 @@ func (d *Database) prepare(p *Request) (*sql.DB, error) {
 		}
 	}
 
-	return d.conn[name], nil
+	return db, nil
 }
 
 // Connect to database 'db'
@@ -513,7 +571,7 @@ func (d *Database) connect(db string) (*sql.DB, error) {
 
 	conn, error := sql.Open("mysql", uname+":"+pass+"@tcp("+addr+":"+port+")/"+db+"?charset=utf8")
 	if error != nil {
-		return nil, fmt.Errorf("Error connecting to database: %s\n", error)
+		return nil, server.Errorf(server.Unavailable, "Error connecting to database: %s", error)
 	}
 
 	error = getMetaCache(conn, "", "")
@@ -530,7 +588,8 @@ func (d *Database) Setup(config *config.Config) error {
 	// Initialize memcache client.
 	address, _ := config.String("memcache", "address")
 	port, _ := config.String("memcache", "port")
-	dataCache = memcache.New(address + ":" + port)
+	cacheServers.SetServers(address + ":" + port)
+	dataCache = memcache.NewFromSelector(&cacheServers)
 
 	// Initialize metadata cache.
 	metaCache.data = make(map[string]map[string]map[string]bool)
@@ -538,10 +597,84 @@ func (d *Database) Setup(config *config.Config) error {
 	return nil
 }
 
+func (d *Database) Reload(config *config.Config) error {
+	// Point memcache client to new server, if changed.
+	address, _ := config.String("memcache", "address")
+	port, _ := config.String("memcache", "port")
+	if err := cacheServers.SetServers(address + ":" + port); err != nil {
+		return fmt.Errorf("Invalid memcache server address: %s", err)
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	// Close existing connections if MySQL server or credentials have changed,
+	// allowing new connections to be made on demand.
+	for _, option := range []string{"address", "port", "username", "password"} {
+		if d.conf.S("mysql", option) != config.S("mysql", option) {
+			for name, db := range d.conn {
+				go db.Close()
+				delete(d.conn, name)
+			}
+
+			break
+		}
+	}
+
+	d.conf = config
+	return nil
+}
+
+func (d *Database) Shutdown() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	var result error
+	for name, db := range d.conn {
+		if err := db.Close(); err != nil && result == nil {
+			result = fmt.Errorf("Error closing connection to database '%s': %s", name, err)
+		}
+
+		delete(d.conn, name)
+	}
+
+	if dataCache != nil {
+		dataCache.Close()
+	}
+
+	return result
+}
+
+func (d *Database) Health() error {
+	if err := dataCache.Ping(); err != nil {
+		return fmt.Errorf("Memcache server is unreachable: %s", err)
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for name, db := range d.conn {
+		if err := db.Ping(); err != nil {
+			return fmt.Errorf("Database '%s' is unreachable: %s", name, err)
+		}
+	}
+
+	return nil
+}
+
 func init() {
-	server.Register(&Database{
-		&config.Config{},
-		make(map[string]*sql.DB),
-		make(map[string]*config.Config),
+	d := &Database{
+		conf:   &config.Config{},
+		conn:   make(map[string]*sql.DB),
+		client: make(map[int]*config.Config),
+	}
+
+	server.Register(d)
+
+	metrics.NewGaugeFunc("sleepy_database_connections", "Databases connected to.", func() float64 {
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+
+		return float64(len(d.conn))
 	})
 }
@@ -5,8 +5,9 @@
 package database
 
 import (
-	"fmt"
 	"strings"
+
+	"github.com/deuill/sleepy/core/server"
 )
 
 func parseSelect(db, tbl string, cols []interface{}) (string, error) {
@@ -21,24 +22,24 @@ func parseSelect(db, tbl string, cols []interface{}) (string, error) {
 			col = n
 		case map[string]interface{}:
 			if len(n) != 1 {
-				return "", fmt.Errorf("Field name in SELECT portion is malformed")
+				return "", server.Errorf(server.InvalidParams, "Field name in SELECT portion is malformed")
 			}
 
 			for c, a := range n {
 				if _, isStr := a.(string); !isStr {
-					return "", fmt.Errorf("Alias name in SELECT portion is malformed")
+					return "", server.Errorf(server.InvalidParams, "Alias name in SELECT portion is malformed")
 				}
 
 				col = c
 				alias = a.(string)
 			}
 		default:
-			return "", fmt.Errorf("Field name in SELECT portion is malformed")
+			return "", server.Errorf(server.InvalidParams, "Field name in SELECT portion is malformed")
 		}
 
 		fields := strings.Split(col, ".")
 		if len(fields) > 2 || len(fields) < 1 {
-			return "", fmt.Errorf("Field name in SELECT portion is malformed")
+			return "", server.Errorf(server.InvalidParams, "Field name in SELECT portion is malformed")
 		}
 
 		if len(fields) == 2 {
@@ -95,13 +96,13 @@ func parseJoin(db, tbl string, joins []JoinRequest) (string, []interface{}, erro
 		for _, condition := range join.Conditions {
 			fields := strings.Fields(condition)
 			if len(fields) != 3 {
-				return "", nil, fmt.Errorf("Condition in JOIN portion is malformed")
+				return "", nil, server.Errorf(server.InvalidParams, "Condition in JOIN portion is malformed")
 			}
 
 			switch fields[1] {
 			case "=", "<=>", "!=", "<>", ">", "<", ">=", "<=":
 			default:
-				return "", nil, fmt.Errorf("Operator '%s' in JOIN condition is invalid", fields[1])
+				return "", nil, server.Errorf(server.InvalidParams, "Operator '%s' in JOIN condition is invalid", fields[1])
 			}
 
 			cond := make([]string, 2)
@@ -112,7 +113,7 @@ func parseJoin(db, tbl string, joins []JoinRequest) (string, []interface{}, erro
 					t = "?"
 					values = append(values, strings.Trim(val, "\\\""))
 				} else if err != nil {
-					return "", nil, fmt.Errorf("Field name in JOIN condition is malformed: %s", err)
+					return "", nil, server.Errorf(server.InvalidParams, "Field name in JOIN condition is malformed: %s", err)
 				}
 
 				cond[i] = t
@@ -125,7 +126,7 @@ func parseJoin(db, tbl string, joins []JoinRequest) (string, []interface{}, erro
 		switch strings.ToUpper(join.Type) {
 		case "LEFT", "RIGHT", "OUTER", "INNER", "LEFT OUTER", "RIGHT OUTER":
 		default:
-			return "", nil, fmt.Errorf("JOIN type '%s' is invalid", join.Type)
+			return "", nil, server.Errorf(server.InvalidParams, "JOIN type '%s' is invalid", join.Type)
 		}
 
 		query += " " + strings.ToUpper(join.Type) + " JOIN `" + join.Table + "` ON " + strings.Join(c, " AND ")
@@ -155,7 +156,7 @@ func parseFilter(db, tbl string, filters []interface{}) (string, []interface{},
 			case "not":
 				not = true
 			default:
-				return "", nil, fmt.Errorf("Unexpected type '%s' in WHERE/WHERE IN/LIKE portion", k)
+				return "", nil, server.Errorf(server.InvalidParams, "Unexpected type '%s' in WHERE/WHERE IN/LIKE portion", k)
 			}
 		} else if f, isMap := filter.(map[string]interface{}); isMap {
 			switch kind {
@@ -165,12 +166,12 @@ func parseFilter(db, tbl string, filters []interface{}) (string, []interface{},
 				for col, value := range f {
 					fields := strings.Fields(col)
 					if len(fields) > 2 || len(fields) < 1 {
-						return "", nil, fmt.Errorf("Column definition in WHERE portion is malformed")
+						return "", nil, server.Errorf(server.InvalidParams, "Column definition in WHERE portion is malformed")
 					}
 
 					col, err = column(db, tbl, fields[0])
 					if err != nil {
-						return "", nil, fmt.Errorf("Column name in WHERE portion is malformed: %s", err)
+						return "", nil, server.Errorf(server.InvalidParams, "Column name in WHERE portion is malformed: %s", err)
 					}
 
 					op := "="
@@ -181,7 +182,7 @@ func parseFilter(db, tbl string, filters []interface{}) (string, []interface{},
 						case "=", "<=>", "!=", "<>", ">", "<", ">=", "<=":
 							op = fields[1]
 						default:
-							return "", nil, fmt.Errorf("Operator '%s' in WHERE portion is invalid", fields[1])
+							return "", nil, server.Errorf(server.InvalidParams, "Operator '%s' in WHERE portion is invalid", fields[1])
 						}
 					}
 
@@ -204,17 +205,17 @@ func parseFilter(db, tbl string, filters []interface{}) (string, []interface{},
 				}
 			case "where-in":
 				if _, isStr := f["column"].(string); !isStr {
-					return "", nil, fmt.Errorf("Column in WHERE IN portion is not a string")
+					return "", nil, server.Errorf(server.InvalidParams, "Column in WHERE IN portion is not a string")
 				}
 
 				col, err := column(db, tbl, f["column"].(string))
 				if err != nil {
-					return "", nil, fmt.Errorf("Column name in WHERE IN portion is malformed: %s", err)
+					return "", nil, server.Errorf(server.InvalidParams, "Column name in WHERE IN portion is malformed: %s", err)
 				}
 
 				v, isArr := f["in"].([]interface{})
 				if !isArr {
-					return "", nil, fmt.Errorf("Values in WHERE IN portion are not in an array")
+					return "", nil, server.Errorf(server.InvalidParams, "Values in WHERE IN portion are not in an array")
 				}
 
 				if query != " WHERE" {
@@ -240,7 +241,7 @@ func parseFilter(db, tbl string, filters []interface{}) (string, []interface{},
 				for col, value := range f {
 					col, err = column(db, tbl, col)
 					if err != nil {
-						return "", nil, fmt.Errorf("Column name in WHERE LIKE portion is malformed: %s", err)
+						return "", nil, server.Errorf(server.InvalidParams, "Column name in WHERE LIKE portion is malformed: %s", err)
 					}
 
 					if not {
@@ -266,14 +267,14 @@ func parseFilter(db, tbl string, filters []interface{}) (string, []interface{},
 					query += strings.Join(c, " AND")
 				}
 			default:
-				return "", nil, fmt.Errorf("Unexpected type '%s' in WHERE/WHERE IN/LIKE portion", kind)
+				return "", nil, server.Errorf(server.InvalidParams, "Unexpected type '%s' in WHERE/WHERE IN/LIKE portion", kind)
 			}
 
 			kind = ""
 			or = false
 			not = false
 		} else {
-			return "", nil, fmt.Errorf("Unexpected argument in WHERE/WHERE IN/LIKE portion")
+			return "", nil, server.Errorf(server.InvalidParams, "Unexpected argument in WHERE/WHERE IN/LIKE portion")
 		}
 	}
 
@@ -293,7 +294,7 @@ func parseHaving(db, tbl string, filters []interface{}) (string, []interface{},
 			if f == "or" {
 				or = true
 			} else {
-				return "", nil, fmt.Errorf("Unexpected type '%s' in HAVING portion", f)
+				return "", nil, server.Errorf(server.InvalidParams, "Unexpected type '%s' in HAVING portion", f)
 			}
 		case map[string]interface{}:
 			c := make([]string, 0)
@@ -301,12 +302,12 @@ func parseHaving(db, tbl string, filters []interface{}) (string, []interface{},
 			for col, value := range f {
 				fields := strings.Fields(col)
 				if len(fields) > 2 || len(fields) < 1 {
-					return "", nil, fmt.Errorf("Column definition in HAVING portion is malformed")
+					return "", nil, server.Errorf(server.InvalidParams, "Column definition in HAVING portion is malformed")
 				}
 
 				col, err = column(db, tbl, fields[0])
 				if err != nil {
-					return "", nil, fmt.Errorf("Column name in WHERE portion is malformed: %s", err)
+					return "", nil, server.Errorf(server.InvalidParams, "Column name in WHERE portion is malformed: %s", err)
 				}
 
 				op := "="
@@ -317,7 +318,7 @@ func parseHaving(db, tbl string, filters []interface{}) (string, []interface{},
 					case "=", "<=>", "!=", "<>", ">", "<", ">=", "<=":
 						op = fields[1]
 					default:
-						return "", nil, fmt.Errorf("Operator '%s' in HAVING portion is invalid", fields[1])
+						return "", nil, server.Errorf(server.InvalidParams, "Operator '%s' in HAVING portion is invalid", fields[1])
 					}
 				}
 
@@ -341,7 +342,7 @@ func parseHaving(db, tbl string, filters []interface{}) (string, []interface{},
 
 			or = false
 		default:
-			return "", nil, fmt.Errorf("Unexpected argument in HAVING portion")
+			return "", nil, server.Errorf(server.InvalidParams, "Unexpected argument in HAVING portion")
 		}
 	}
 
@@ -354,13 +355,13 @@ func parseOrderBy(db, tbl string, orders []OrderRequest) (string, error) {
 	for _, order := range orders {
 		col, err := column(db, tbl, order.Column)
 		if err != nil {
-			return "", fmt.Errorf("Column name in ORDER BY condition is malformed: %s", err)
+			return "", server.Errorf(server.InvalidParams, "Column name in ORDER BY condition is malformed: %s", err)
 		}
 
 		switch strings.ToUpper(order.Order) {
 		case "ASC", "DESC", "RANDOM":
 		default:
-			return "", fmt.Errorf("Invalid order type '%s' in ORDER BY condition", order.Order)
+			return "", server.Errorf(server.InvalidParams, "Invalid order type '%s' in ORDER BY condition", order.Order)
 		}
 
 		c = append(c, col+" "+strings.ToUpper(order.Order))
@@ -374,7 +375,7 @@ func column(db, tbl, col string) (string, error) {
 
 	split := strings.Split(col, ".")
 	if len(split) > 2 || len(split) < 1 {
-		return "", fmt.Errorf("Column definition is incorrect")
+		return "", server.Errorf(server.InvalidParams, "Column definition is incorrect")
 	}
 
 	if len(split) == 2 {
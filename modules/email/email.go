@@ -7,24 +7,35 @@
 package email
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/base64"
+	"errors"
+	"fmt"
 	"net"
 	"net/mail"
 	"net/smtp"
+	"net/textproto"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/deuill/sleepy/core/config"
+	"github.com/deuill/sleepy/core/metrics"
 	"github.com/deuill/sleepy/core/server"
 )
 
+// Messages currently being sent.
+var sending = metrics.NewGauge("sleepy_email_sending", "Messages currently being sent.")
+
 type Email struct {
 	// Contains private or unexported fields.
 	host     string
 	port     string
 	username string
 	password string
+	pending  sync.WaitGroup
+	mutex    sync.RWMutex
 }
 
 type Request struct {
@@ -37,7 +48,7 @@ type Request struct {
 		Address string
 		Name    string
 	}
-	To     []string
+	To     []string `sleepy:"required"`
 	Cc     []string
 	Bcc    []string
 	Attach []struct {
@@ -47,16 +58,26 @@ type Request struct {
 	}
 }
 
-func (e *Email) Send(p Request) (bool, error) {
+func (e *Email) Send(ctx context.Context, p Request) (bool, error) {
 	var body, boundary, ctype string
 
+	e.pending.Add(1)
+	defer e.pending.Done()
+
+	sending.Add(1)
+	defer sending.Add(-1)
+
+	e.mutex.RLock()
+	host, port, username, password := e.host, e.port, e.username, e.password
+	e.mutex.RUnlock()
+
 	var auth smtp.Auth
-	if e.username != "" && e.password != "" {
+	if username != "" && password != "" {
 		auth = smtp.PlainAuth(
 			"",
-			e.username,
-			e.password,
-			e.host,
+			username,
+			password,
+			host,
 		)
 	}
 
@@ -105,17 +126,52 @@ func (e *Email) Send(p Request) (bool, error) {
 		body += "\r\n" + base64.StdEncoding.EncodeToString([]byte(p.Message.Content))
 	}
 
-	err := sendMail(e.host+":"+e.port, auth, from.Address, p.To, []byte(body))
+	err := sendMail(ctx, host+":"+port, auth, from.Address, p.To, []byte(body))
 	if err != nil {
-		return false, err
+		return false, sendError(err)
 	}
 
 	return true, nil
 }
 
-func sendMail(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
-	c, err := smtp.Dial(addr)
+// Return error for failure in sending message, distinguishing between messages
+// rejected by the SMTP server, which are not to be sent again, and temporary
+// failures, such as the SMTP server being unreachable.
+func sendError(err error) error {
+	var te *textproto.Error
+	var ne net.Error
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return err
+	case errors.As(err, &te) && te.Code >= 500:
+		return server.Errorf(server.InvalidParams, "Message rejected by SMTP server: %s", te.Msg).WithData(map[string]interface{}{
+			"code": te.Code,
+		})
+	case errors.As(err, &te):
+		return server.Errorf(server.Unavailable, "SMTP server is unavailable: %s", te.Msg).WithData(map[string]interface{}{
+			"code": te.Code,
+		})
+	case errors.As(err, &ne):
+		return server.Errorf(server.Unavailable, "SMTP server is unreachable: %s", err)
+	}
+
+	return err
+}
+
+// Send message via SMTP server at 'addr', aborting the SMTP session when 'ctx'
+// is done.
+func sendMail(ctx context.Context, addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	host, _, _ := net.SplitHostPort(addr)
+	c, err := smtp.NewClient(conn, host)
 	if err != nil {
+		conn.Close()
 		return err
 	}
 	if ok, _ := c.Extension("STARTTLS"); ok {
@@ -167,6 +223,42 @@ func (e *Email) Setup(config *config.Config) error {
 	return nil
 }
 
+func (e *Email) Reload(config *config.Config) error {
+	host, _ := config.String("email", "host")
+	port, _ := config.String("email", "port")
+	if host == "" || port == "" {
+		return fmt.Errorf("SMTP server host and port are required")
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.host, e.port = host, port
+	e.username, _ = config.String("auth", "username")
+	e.password, _ = config.String("auth", "password")
+
+	return nil
+}
+
+func (e *Email) Shutdown() error {
+	// Wait for messages currently being sent.
+	e.pending.Wait()
+	return nil
+}
+
+func (e *Email) Health() error {
+	e.mutex.RLock()
+	addr := e.host + ":" + e.port
+	e.mutex.RUnlock()
+
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("SMTP server is unreachable: %s", err)
+	}
+
+	return conn.Close()
+}
+
 func init() {
 	server.Register(&Email{})
 }
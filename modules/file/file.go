@@ -7,6 +7,7 @@
 package file
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
@@ -21,32 +22,38 @@ import (
 type File struct {
 	// Contains private or unexported fields.
 	conf *config.Config
-	id   map[string]string
 }
 
 type Request struct {
 	Auth     string
 	Remote   string
-	Checksum string
+	Checksum string `sleepy:"required"`
 	Filename string
 }
 
-func (f *File) Get(p Request) (string, error) {
-	path, err := f.filepath(&p)
+func (f *File) Get(ctx context.Context, p Request) (string, error) {
+	id, err := f.owner(ctx, &p)
 	if err != nil {
-		return "", nil
+		return "", err
 	}
 
-	dir, err := os.Open(f.conf.S("directories", "data") + "/serve" + path)
+	path, err := f.filepath(id, &p)
 	if err != nil {
-		return "", nil
+		return "", err
+	}
+
+	dir, err := os.Open(f.conf.S("directories", "data") + "/serve" + path)
+	if os.IsNotExist(err) {
+		return "", server.Errorf(server.NotFound, "File with checksum '%s' does not exist.", p.Checksum)
+	} else if err != nil {
+		return "", server.Errorf(server.InternalError, "Unable to open file directory: %s", err)
 	}
 
 	defer dir.Close()
 
 	files, err := dir.Readdir(-1)
-	if len(files) == 0 {
-		return "", nil
+	if err != nil {
+		return "", server.Errorf(server.InternalError, "Unable to read file directory: %s", err)
 	}
 
 	var filename string
@@ -63,30 +70,40 @@ func (f *File) Get(p Request) (string, error) {
 		return f.conf.S("http", "address") + ":" + f.conf.S("http", "port") + path + filename, nil
 	}
 
-	return "", nil
+	return "", server.Errorf(server.NotFound, "File with checksum '%s' does not exist.", p.Checksum)
 }
 
-func (f *File) Upload(p Request) (string, error) {
-	path, err := f.filepath(&p)
+func (f *File) Upload(ctx context.Context, p Request) (string, error) {
+	id, err := f.owner(ctx, &p)
 	if err != nil {
-		return "", nil
+		return "", err
+	}
+
+	path, err := f.filepath(id, &p)
+	if err != nil {
+		return "", err
 	}
 
 	var src io.ReadCloser
 	if p.Remote != "" {
-		resp, err := http.Get(p.Remote)
+		req, err := http.NewRequestWithContext(ctx, "GET", p.Remote, nil)
 		if err != nil {
-			return "", nil
+			return "", server.Errorf(server.InvalidParams, "Remote address is invalid: %s", err)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return "", server.Errorf(server.Unavailable, "Receiving file failed: %s", err)
 		} else if resp.StatusCode != 200 {
 			resp.Body.Close()
-			return "", nil
+			return "", remoteError(resp.StatusCode)
 		}
 
 		src = resp.Body
 	} else {
-		tmpfile := os.TempDir() + "/sleepy/" + f.id[p.Auth] + "/" + p.Checksum
+		tmpfile := os.TempDir() + "/sleepy/" + id + "/" + p.Checksum
 		if src, err = os.Open(tmpfile); err != nil {
-			return "", nil
+			return "", server.Errorf(server.NotFound, "No file with checksum '%s' has been sent.", p.Checksum)
 		}
 
 		defer os.Remove(tmpfile)
@@ -96,63 +113,99 @@ func (f *File) Upload(p Request) (string, error) {
 
 	datadir := f.conf.S("directories", "data")
 	if err = os.MkdirAll(datadir+"/serve"+path, 0755); err != nil {
-		return "", nil
+		return "", server.Errorf(server.InternalError, "Unable to create file directory: %s", err)
 	}
 
 	dst, err := os.Create(datadir + "/serve" + path + p.Filename)
 	if err != nil {
-		return "", nil
+		return "", server.Errorf(server.InternalError, "Unable to create file: %s", err)
 	}
 
 	defer dst.Close()
-	io.Copy(dst, src)
+	if _, err = io.Copy(dst, src); err != nil {
+		return "", server.Errorf(server.InternalError, "Unable to write file: %s", err)
+	}
 
 	return f.conf.S("http", "address") + ":" + f.conf.S("http", "port") + path + p.Filename, nil
 }
 
-func (f *File) Delete(p Request) (bool, error) {
-	path, err := f.filepath(&p)
+func (f *File) Delete(ctx context.Context, p Request) (bool, error) {
+	id, err := f.owner(ctx, &p)
 	if err != nil {
 		return false, err
 	}
 
-	if err = os.RemoveAll(f.conf.S("directories", "data") + "/serve" + path); err != nil {
+	path, err := f.filepath(id, &p)
+	if err != nil {
 		return false, err
 	}
 
+	if err = os.RemoveAll(f.conf.S("directories", "data") + "/serve" + path); err != nil {
+		return false, server.Errorf(server.InternalError, "Unable to remove file: %s", err)
+	}
+
 	return true, nil
 }
 
-func (f *File) filepath(p *Request) (string, error) {
-	if len(p.Checksum) != 40 {
-		return "", fmt.Errorf("checksum does not appear to be an SHA1 hash.")
+// Return id of user owning files for request, as authenticated by the authkey
+// given or, if none is given, the user making the call.
+func (f *File) owner(ctx context.Context, p *Request) (string, error) {
+	if u := server.Caller(ctx); p.Auth == "" && u != nil {
+		return strconv.Itoa(u.Id), nil
 	}
 
-	if _, exists := f.id[p.Auth]; !exists {
-		u, err := user.Auth(p.Auth)
-		if err != nil {
-			return "", err
-		}
+	u, err := user.Auth(p.Auth)
+	if err != nil {
+		return "", server.Errorf(server.Unauthorized, "%s", err)
+	}
+
+	return strconv.Itoa(u.Id), nil
+}
 
-		f.id[p.Auth] = strconv.FormatInt(int64(u.Id), 10)
+func (f *File) filepath(id string, p *Request) (string, error) {
+	if len(p.Checksum) != 40 {
+		return "", server.Errorf(server.InvalidParams, "Checksum does not appear to be an SHA1 hash.")
 	}
 
 	c := p.Checksum
 	hash := c[:2] + "/" + c[2:6] + "/" + c[6:14] + "/" + c[14:27] + "/" + c[27:]
-	path := "/" + f.id[p.Auth] + "/" + hash + "/"
+	path := "/" + id + "/" + hash + "/"
 
 	return path, nil
 }
 
+// Return error for remote file request failing with HTTP status 'status'.
+func remoteError(status int) error {
+	code := server.Unavailable
+	if status == http.StatusNotFound {
+		code = server.NotFound
+	}
+
+	return server.Errorf(code, "Receiving file failed with code: %d", status).WithData(map[string]interface{}{
+		"status": status,
+	})
+}
+
 func (f *File) Setup(config *config.Config) error {
 	f.conf = config
 
 	return nil
 }
 
+func (f *File) Shutdown() error {
+	return nil
+}
+
+func (f *File) Health() error {
+	if _, err := os.Stat(f.conf.S("directories", "data")); err != nil {
+		return fmt.Errorf("Data directory is inaccessible: %s", err)
+	}
+
+	return nil
+}
+
 func init() {
 	server.Register(&File{
 		&config.Config{},
-		make(map[string]string),
 	})
 }
@@ -7,6 +7,7 @@
 package image
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
 	"image"
@@ -28,13 +29,12 @@ import (
 type Image struct {
 	// Contains private or unexported fields.
 	conf *config.Config
-	id   map[string]string
 }
 
 type Request struct {
 	Auth     string
 	Remote   string
-	Checksum string
+	Checksum string `sleepy:"required"`
 	Filename string
 	W        int64
 	H        int64
@@ -43,26 +43,31 @@ type Request struct {
 	Aspect   float64
 }
 
-func (i *Image) Crop(p Request) (string, error) {
+func (i *Image) Crop(ctx context.Context, p Request) (string, error) {
 	datadir := i.conf.S("directories", "data")
 	address := i.conf.S("http", "address")
 	port := i.conf.S("http", "port")
 
-	path, err := i.filepath(fmt.Sprintf("op=crop;x=%d;y=%d;w=%d;h=%d", p.X, p.Y, p.W, p.H), &p)
+	id, err := i.owner(ctx, &p)
 	if err != nil {
-		return "", nil
+		return "", err
+	}
+
+	path, err := i.filepath(id, fmt.Sprintf("op=crop;x=%d;y=%d;w=%d;h=%d", p.X, p.Y, p.W, p.H), &p)
+	if err != nil {
+		return "", err
 	}
 
 	// Check for cached file.
 	if _, err = os.Stat(datadir + "/serve" + path + p.Filename); err == nil {
-		os.Remove(os.TempDir() + "/sleepy/" + i.id[p.Auth] + "/" + p.Checksum)
+		os.Remove(os.TempDir() + "/sleepy/" + id + "/" + p.Checksum)
 		return address + ":" + port + path + p.Filename, nil
 	}
 
 	// Upload and process image.
-	img, format, err := i.upload(&p)
+	img, format, err := i.upload(ctx, id, &p)
 	if err != nil {
-		return "", nil
+		return "", err
 	}
 
 	b := img.Bounds()
@@ -78,35 +83,43 @@ func (i *Image) Crop(p Request) (string, error) {
 
 		err = generate(t, format, datadir+"/serve"+path, p.Filename)
 		if err != nil {
-			return "", nil
+			return "", err
 		}
 
 		return address + ":" + port + path + p.Filename, nil
 	}
 
-	return "", nil
+	return "", server.Errorf(server.InvalidParams, "Crop area is outside the bounds of the image.").WithData(map[string]interface{}{
+		"width":  b.Max.X,
+		"height": b.Max.Y,
+	})
 }
 
-func (i *Image) Resize(p Request) (string, error) {
+func (i *Image) Resize(ctx context.Context, p Request) (string, error) {
 	datadir, _ := i.conf.String("directories", "data")
 	address, _ := i.conf.String("http", "address")
 	port, _ := i.conf.String("http", "port")
 
-	path, err := i.filepath(fmt.Sprintf("op=resize;w=%d;h=%d;a=%f", p.W, p.H, p.Aspect), &p)
+	id, err := i.owner(ctx, &p)
 	if err != nil {
-		return "", nil
+		return "", err
+	}
+
+	path, err := i.filepath(id, fmt.Sprintf("op=resize;w=%d;h=%d;a=%f", p.W, p.H, p.Aspect), &p)
+	if err != nil {
+		return "", err
 	}
 
 	// Check for cached file.
 	if _, err = os.Stat(datadir + "/serve" + path + p.Filename); err == nil {
-		os.Remove(os.TempDir() + "/sleepy/" + i.id[p.Auth] + "/" + p.Checksum)
+		os.Remove(os.TempDir() + "/sleepy/" + id + "/" + p.Checksum)
 		return address + ":" + port + path + p.Filename, nil
 	}
 
 	// Upload and process image.
-	img, format, err := i.upload(&p)
+	img, format, err := i.upload(ctx, id, &p)
 	if err != nil {
-		return "", nil
+		return "", err
 	}
 
 	var t image.Image
@@ -121,53 +134,64 @@ func (i *Image) Resize(p Request) (string, error) {
 
 	err = generate(t, format, datadir+"/serve"+path, p.Filename)
 	if err != nil {
-		return "", nil
+		return "", err
 	}
 
 	return address + ":" + port + path + p.Filename, nil
 }
 
-func (i *Image) filepath(options string, p *Request) (string, error) {
-	if len(p.Checksum) != 40 {
-		return "", fmt.Errorf("checksum does not appear to be an SHA-1 hash.")
+// Return id of user owning files for request, as authenticated by the authkey
+// given or, if none is given, the user making the call.
+func (i *Image) owner(ctx context.Context, p *Request) (string, error) {
+	if u := server.Caller(ctx); p.Auth == "" && u != nil {
+		return strconv.Itoa(u.Id), nil
 	}
 
-	if _, exists := i.id[p.Auth]; !exists {
-		u, err := user.Auth(p.Auth)
-		if err != nil {
-			return "", err
-		}
+	u, err := user.Auth(p.Auth)
+	if err != nil {
+		return "", server.Errorf(server.Unauthorized, "%s", err)
+	}
 
-		i.id[p.Auth] = strconv.FormatInt(int64(u.Id), 10)
+	return strconv.Itoa(u.Id), nil
+}
+
+func (i *Image) filepath(id, options string, p *Request) (string, error) {
+	if len(p.Checksum) != 40 {
+		return "", server.Errorf(server.InvalidParams, "Checksum does not appear to be an SHA-1 hash.")
 	}
 
 	c := p.Checksum
 	hash := c[:2] + "/" + c[2:6] + "/" + c[6:14] + "/" + c[14:27] + "/" + c[27:]
 
 	opts := base64.StdEncoding.EncodeToString([]byte(options))
-	path := "/" + i.id[p.Auth] + "/" + hash + "/" + opts + "/"
+	path := "/" + id + "/" + hash + "/" + opts + "/"
 
 	return path, nil
 }
 
-func (i *Image) upload(p *Request) (image.Image, string, error) {
+func (i *Image) upload(ctx context.Context, id string, p *Request) (image.Image, string, error) {
 	var err error
 	var src io.ReadCloser
 
 	if p.Remote != "" {
-		resp, err := http.Get(p.Remote)
+		req, err := http.NewRequestWithContext(ctx, "GET", p.Remote, nil)
+		if err != nil {
+			return nil, "", server.Errorf(server.InvalidParams, "Remote address is invalid: %s", err)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
 		if err != nil {
-			return nil, "", err
+			return nil, "", server.Errorf(server.Unavailable, "Receiving image failed: %s", err)
 		} else if resp.StatusCode != 200 {
 			resp.Body.Close()
-			return nil, "", fmt.Errorf("receiving image failed with code: %d", resp.StatusCode)
+			return nil, "", remoteError(resp.StatusCode)
 		}
 
 		src = resp.Body
 	} else {
-		tmpfile := os.TempDir() + "/sleepy/" + i.id[p.Auth] + "/" + p.Checksum
+		tmpfile := os.TempDir() + "/sleepy/" + id + "/" + p.Checksum
 		if src, err = os.Open(tmpfile); err != nil {
-			return nil, "", err
+			return nil, "", server.Errorf(server.NotFound, "No image with checksum '%s' has been sent.", p.Checksum)
 		}
 
 		defer os.Remove(tmpfile)
@@ -177,30 +201,48 @@ func (i *Image) upload(p *Request) (image.Image, string, error) {
 
 	img, format, err := image.Decode(src)
 	if err != nil {
-		return nil, "", fmt.Errorf("image could not be decoded: %s", err)
+		return nil, "", server.Errorf(server.InvalidParams, "Image could not be decoded: %s", err)
 	}
 
 	return img, format, nil
 }
 
+// Return error for remote image request failing with HTTP status 'status'.
+func remoteError(status int) error {
+	code := server.Unavailable
+	if status == http.StatusNotFound {
+		code = server.NotFound
+	}
+
+	return server.Errorf(code, "Receiving image failed with code: %d", status).WithData(map[string]interface{}{
+		"status": status,
+	})
+}
+
 func generate(img image.Image, format, path, filename string) error {
 	err := os.MkdirAll(path, 0755)
 	if err != nil {
-		return err
+		return server.Errorf(server.InternalError, "Unable to create image directory: %s", err)
 	}
 
 	out, err := os.Create(path + filename)
 	if err != nil {
-		return err
+		return server.Errorf(server.InternalError, "Unable to create image: %s", err)
 	}
 
 	defer out.Close()
 
 	switch format {
 	case "jpeg":
-		jpeg.Encode(out, img, &jpeg.Options{90})
+		err = jpeg.Encode(out, img, &jpeg.Options{90})
 	case "png":
-		png.Encode(out, img)
+		err = png.Encode(out, img)
+	default:
+		return server.Errorf(server.InvalidParams, "Image format '%s' is not supported.", format)
+	}
+
+	if err != nil {
+		return server.Errorf(server.InternalError, "Unable to encode image: %s", err)
 	}
 
 	return nil
@@ -212,9 +254,20 @@ func (i *Image) Setup(config *config.Config) error {
 	return nil
 }
 
+func (i *Image) Shutdown() error {
+	return nil
+}
+
+func (i *Image) Health() error {
+	if _, err := os.Stat(i.conf.S("directories", "data")); err != nil {
+		return fmt.Errorf("Data directory is inaccessible: %s", err)
+	}
+
+	return nil
+}
+
 func init() {
 	server.Register(&Image{
 		&config.Config{},
-		make(map[string]string),
 	})
 }
@@ -7,11 +7,14 @@
 package template
 
 import (
+	"context"
 	"crypto/sha1"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/deuill/sleepy/core/config"
 	"github.com/deuill/sleepy/core/server"
@@ -52,13 +55,37 @@ type Request struct {
 	Data map[string]interface{}
 }
 
-func (t *Template) Render(p Request) (string, error) {
+func (t *Template) Render(ctx context.Context, p Request) (string, error) {
+	// Files are cached under the id of the user making the call or, if none is
+	// known, the user id given.
+	if u := server.Caller(ctx); u != nil {
+		p.Auth = strconv.Itoa(u.Id)
+	} else if _, err := strconv.ParseUint(p.Auth, 10, 0); err != nil {
+		return "", server.Errorf(server.InvalidParams, "User id '%s' is not valid.", p.Auth)
+	}
+
+	// Files are not allowed to be read from or written to outside the cache.
+	paths := []string{p.Template.Path, p.Layout.Path}
+	for _, partial := range p.Partials {
+		paths = append(paths, partial.Path)
+	}
+
+	for _, table := range p.I18n.Tables {
+		paths = append(paths, table.Path)
+	}
+
+	for _, path := range paths {
+		if path != "" && !filepath.IsLocal(strings.TrimLeft(path, "/")) {
+			return "", server.Errorf(server.InvalidParams, "Path '%s' is outside the template cache.", path)
+		}
+	}
+
 	// Check cache and fill in data, if available.
 	if p.Template.Checksum != "" {
 		p.Template.Data = t.check(p.Template.Path, p.Auth, p.Template.Checksum)
 
 		if p.Template.Data == "" {
-			return "", nil
+			return "", notCached(p.Template.Path)
 		}
 	}
 
@@ -66,7 +93,7 @@ func (t *Template) Render(p Request) (string, error) {
 		p.Layout.Data = t.check(p.Layout.Path, p.Auth, p.Layout.Checksum)
 
 		if p.Layout.Data == "" {
-			return "", nil
+			return "", notCached(p.Layout.Path)
 		}
 	}
 
@@ -75,7 +102,7 @@ func (t *Template) Render(p Request) (string, error) {
 			p.Partials[i].Data = t.check(partial.Path, p.Auth, partial.Checksum)
 
 			if p.Partials[i].Data == "" {
-				return "", nil
+				return "", notCached(partial.Path)
 			}
 		}
 	}
@@ -85,13 +112,13 @@ func (t *Template) Render(p Request) (string, error) {
 			p.I18n.Tables[i].Data = t.check(table.Path, p.Auth, table.Checksum)
 
 			if p.I18n.Tables[i].Data == "" {
-				return "", nil
+				return "", notCached(table.Path)
 			}
 		}
 	}
 
 	if p.Template.Data == "" {
-		return "", fmt.Errorf("Template is empty, please specify a valid template")
+		return "", server.Errorf(server.InvalidParams, "Template is empty, please specify a valid template")
 	} else if p.Template.Checksum == "" && p.Template.Path != "" {
 		t.store(p.Template.Path, p.Auth, p.Template.Data)
 	}
@@ -134,7 +161,7 @@ func (t *Template) Render(p Request) (string, error) {
 
 		parser, err := New(result, tables, "[[", "]]")
 		if err != nil {
-			return "", nil
+			return "", server.Errorf(server.InvalidParams, "Translation table is malformed: %s", err)
 		}
 
 		result = parser.Execute(p.I18n.Origin, p.I18n.Target)
@@ -159,6 +186,14 @@ func (t *Template) check(path, authkey, checksum string) string {
 	return ""
 }
 
+// Return error for file at 'path' not being in cache, or not matching the
+// checksum given. Clients are expected to send the file contents in full.
+func notCached(path string) error {
+	return server.Errorf(server.NotFound, "File '%s' is not cached or has changed.", path).WithData(map[string]interface{}{
+		"path": path,
+	})
+}
+
 func (t *Template) store(path, authkey, template string) error {
 	datadir, _ := t.conf.String("directories", "data")
 
@@ -188,6 +223,18 @@ func (t *Template) Setup(config *config.Config) error {
 	return nil
 }
 
+func (t *Template) Shutdown() error {
+	return nil
+}
+
+func (t *Template) Health() error {
+	if _, err := os.Stat(t.conf.S("directories", "data")); err != nil {
+		return fmt.Errorf("Data directory is inaccessible: %s", err)
+	}
+
+	return nil
+}
+
 func init() {
 	server.Register(&Template{nil})
 }
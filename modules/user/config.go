@@ -5,25 +5,26 @@
 package user
 
 import (
+	"github.com/deuill/sleepy/core/server"
 	"github.com/deuill/sleepy/core/user"
 )
 
 type GetRequest struct {
-	Id      int
+	Id      int `sleepy:"required"`
 	Module  string
 	Section string
 	Option  string
 }
 
 type SetRequest struct {
-	Id   int
+	Id   int `sleepy:"required"`
 	Data map[string]map[string]map[string]interface{}
 }
 
 func (u *User) GetOption(p GetRequest) (string, error) {
 	data, err := user.Get(p.Id)
 	if err != nil {
-		return "", err
+		return "", server.Errorf(server.NotFound, "%s", err)
 	}
 
 	conf, err := data.Conf(p.Module)
@@ -33,7 +34,7 @@ func (u *User) GetOption(p GetRequest) (string, error) {
 
 	value, err := conf.String(p.Section, p.Option)
 	if err != nil {
-		return "", err
+		return "", server.Errorf(server.NotFound, "%s", err)
 	}
 
 	return value, nil
@@ -42,7 +43,7 @@ func (u *User) GetOption(p GetRequest) (string, error) {
 func (u *User) SetOption(p SetRequest) (bool, error) {
 	data, err := user.Get(p.Id)
 	if err != nil {
-		return false, err
+		return false, server.Errorf(server.NotFound, "%s", err)
 	}
 
 	for module, sections := range p.Data {
@@ -62,7 +63,7 @@ func (u *User) SetOption(p SetRequest) (bool, error) {
 func (u *User) DeleteOption(p GetRequest) (bool, error) {
 	data, err := user.Get(p.Id)
 	if err != nil {
-		return false, err
+		return false, server.Errorf(server.NotFound, "%s", err)
 	}
 
 	_, err = data.DeleteOption(p.Module, p.Section, p.Option)
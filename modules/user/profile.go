@@ -0,0 +1,84 @@
+// Copyright 2012 - 2014 Alex Palaistras. All rights reserved.
+// Use of this source code is governed by the MIT License, the
+// full text of which can be found in the LICENSE file.
+
+package user
+
+import (
+	"github.com/deuill/sleepy/core/server"
+	"github.com/deuill/sleepy/core/user"
+)
+
+// UpdateRequest sets fields in a user's profile. Fields left unset are kept
+// as they are, while labels, if set, replace all labels given to the user.
+type UpdateRequest struct {
+	Id     int `sleepy:"required"`
+	Name   *string
+	Email  *string
+	Labels []string
+	Status *string
+}
+
+func (u *User) Find(p user.Filter) (interface{}, error) {
+	result, err := user.Find(p)
+	if err != nil {
+		return false, err
+	}
+
+	return result, nil
+}
+
+func (u *User) Update(p UpdateRequest) (interface{}, error) {
+	data, err := user.Get(p.Id)
+	if err != nil {
+		return false, server.Errorf(server.NotFound, "%s", err)
+	}
+
+	if p.Name != nil {
+		data.Name = *p.Name
+	}
+
+	if p.Email != nil {
+		data.Email = *p.Email
+	}
+
+	if p.Labels != nil {
+		data.Labels = p.Labels
+	}
+
+	if p.Status != nil {
+		data.Status = *p.Status
+	}
+
+	if err = data.Update(); err != nil {
+		return false, server.Errorf(server.InvalidParams, "%s", err)
+	}
+
+	return data, nil
+}
+
+func (u *User) Suspend(id float64) (bool, error) {
+	data, err := user.Get(int(id))
+	if err != nil {
+		return false, server.Errorf(server.NotFound, "%s", err)
+	}
+
+	if err = data.Suspend(); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (u *User) Enable(id float64) (bool, error) {
+	data, err := user.Get(int(id))
+	if err != nil {
+		return false, server.Errorf(server.NotFound, "%s", err)
+	}
+
+	if err = data.Enable(); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
@@ -7,6 +7,7 @@
 package user
 
 import (
+	"github.com/deuill/sleepy/core/config"
 	"github.com/deuill/sleepy/core/server"
 	"github.com/deuill/sleepy/core/user"
 )
@@ -16,7 +17,7 @@ type User struct {}
 func (u *User) Auth(authkey string) (interface{}, error) {
 	result, err := user.Auth(authkey)
 	if err != nil {
-		return false, err
+		return false, server.Errorf(server.Unauthorized, "%s", err)
 	}
 
 	return result, nil
@@ -25,7 +26,7 @@ func (u *User) Auth(authkey string) (interface{}, error) {
 func (u *User) Get(id float64) (interface{}, error) {
 	result, err := user.Get(int(id))
 	if err != nil {
-		return false, err
+		return false, server.Errorf(server.NotFound, "%s", err)
 	}
 
 	return result, nil
@@ -58,6 +59,18 @@ func (u *User) List() (interface{}, error) {
 	return result, nil
 }
 
+func (u *User) Setup(config *config.Config) error {
+	return nil
+}
+
+func (u *User) Shutdown() error {
+	return nil
+}
+
+func (u *User) Health() error {
+	return user.Ping()
+}
+
 func init() {
 	server.Register(&User{})
 }